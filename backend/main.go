@@ -1,62 +1,209 @@
 package main
 
 import (
+	"bytes"
+	"container/heap"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"database/sql"
 	"encoding/json"
 	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	mathrand "math/rand/v2"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/mail"
+	"net/smtp"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"net/url"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	_ "modernc.org/sqlite"
 )
 
+// Config is loaded from environment variables. The yaml/json tags name the
+// same settings for CONFIG_FILE: each tag is the lower-cased env var name.
 type Config struct {
-	SupabaseURL    string
-	SupabaseAnonKey string
-	Port           string
-	CORSOrigin     string
-	PingTimeout    time.Duration
-	PingRetries    int
-	PingRetryDelay time.Duration
-	DegradedMs     int64
-	WebhookURL     string
-	SlackWebhookURL   string
-	DiscordWebhookURL string
-
-	ConfirmBaseURL         string
-	ConfirmTokenTTLMinutes int
-	ConfirmTokenSecret     string
-	ConfirmStorePath       string
-
-	EmailJSServiceID  string
-	EmailJSTemplateID string
-	EmailJSPublicKey  string
-	EmailJSPrivateKey string
-}
-
-func loadConfig() (Config, error) {
+	SupabaseURL       string        `yaml:"supabase_url" json:"supabase_url"`
+	SupabaseAnonKey   string        `yaml:"supabase_anon_key" json:"supabase_anon_key"`
+	Port              string        `yaml:"port" json:"port"`
+	CORSOrigins       []string      `yaml:"cors_origin" json:"cors_origin"`
+	PingTimeout       time.Duration `yaml:"ping_timeout_ms" json:"ping_timeout_ms"`
+	PingRetries       int           `yaml:"ping_retries" json:"ping_retries"`
+	PingRetryDelay    time.Duration `yaml:"ping_retry_delay_ms" json:"ping_retry_delay_ms"`
+	PingRetryBackoff  string        `yaml:"ping_retry_backoff" json:"ping_retry_backoff"`
+	PingUserAgent     string        `yaml:"ping_user_agent" json:"ping_user_agent"`
+	PingMaxBodyBytes  int64         `yaml:"ping_max_body_bytes" json:"ping_max_body_bytes"`
+	PingForceHTTP2    bool          `yaml:"ping_force_http2" json:"ping_force_http2"`
+	PingMinTLS        uint16        `yaml:"min_tls_version" json:"min_tls_version"`
+	ICMPCount         int           `yaml:"icmp_count" json:"icmp_count"`
+	DegradedMs        int64         `yaml:"degraded_latency_ms" json:"degraded_latency_ms"`
+	SlowMs            int64         `yaml:"slow_latency_ms" json:"slow_latency_ms"`
+	FailureThreshold  int           `yaml:"failure_threshold" json:"failure_threshold"`
+	RecoveryThreshold int           `yaml:"recovery_threshold" json:"recovery_threshold"`
+	WebhookURL        string        `yaml:"webhook_url" json:"webhook_url"`
+	SlackWebhookURL   string        `yaml:"slack_webhook_url" json:"slack_webhook_url"`
+	DiscordWebhookURL string        `yaml:"discord_webhook_url" json:"discord_webhook_url"`
+	TeamsWebhookURL   string        `yaml:"teams_webhook_url" json:"teams_webhook_url"`
+	TelegramBotToken  string        `yaml:"telegram_bot_token" json:"telegram_bot_token"`
+	TelegramChatID    string        `yaml:"telegram_chat_id" json:"telegram_chat_id"`
+
+	// AlertWebhookURL and RecoveryWebhookURL replace WebhookURL for failure
+	// and recovery incidents respectively when set.
+	AlertWebhookURL    string `yaml:"alert_webhook_url" json:"alert_webhook_url"`
+	RecoveryWebhookURL string `yaml:"recovery_webhook_url" json:"recovery_webhook_url"`
+	WebhookTemplate    string `yaml:"webhook_template" json:"webhook_template"`
+	WebhookContentType string `yaml:"webhook_content_type" json:"webhook_content_type"`
+	WebhookFormat      string `yaml:"webhook_format" json:"webhook_format"`
+	MinNotifySeverity  string `yaml:"min_notify_severity" json:"min_notify_severity"`
+	// EscalationInterval re-notifies a still-DOWN project this often; 0 = off.
+	EscalationInterval time.Duration `yaml:"escalation_interval_minutes" json:"escalation_interval_minutes"`
+	// DisplayTimezone is the zone for human-readable times in alert text.
+	DisplayTimezone *time.Location `yaml:"display_timezone" json:"display_timezone"`
+
+	ConfirmBaseURL         string        `yaml:"confirm_base_url" json:"confirm_base_url"`
+	ConfirmTokenTTLMinutes int           `yaml:"confirm_token_ttl_minutes" json:"confirm_token_ttl_minutes"`
+	ConfirmTokenSecret     string        `yaml:"confirm_token_secret" json:"confirm_token_secret"`
+	ConfirmTokenSecretsOld []string      `yaml:"confirm_token_secret_old" json:"confirm_token_secret_old"`
+	ConfirmStorePath       string        `yaml:"confirm_store_path" json:"confirm_store_path"`
+	ConfirmRetentionDays   int           `yaml:"confirm_retention_days" json:"confirm_retention_days"`
+	ConfirmWALPath         string        `yaml:"confirm_wal_path" json:"confirm_wal_path"`
+	ConfirmCompaction      time.Duration `yaml:"confirm_compaction_hours" json:"confirm_compaction_hours"`
+
+	EmailJSServiceID  string `yaml:"emailjs_service_id" json:"emailjs_service_id"`
+	EmailJSTemplateID string `yaml:"emailjs_template_id" json:"emailjs_template_id"`
+	EmailJSPublicKey  string `yaml:"emailjs_public_key" json:"emailjs_public_key"`
+	EmailJSPrivateKey string `yaml:"emailjs_private_key" json:"emailjs_private_key"`
+
+	RateLimitSweepInterval time.Duration `yaml:"rate_limit_sweep_seconds" json:"rate_limit_sweep_seconds"`
+	RateLimitAlgo          string        `yaml:"rate_limit_algo" json:"rate_limit_algo"`
+
+	StoreBackend   string `yaml:"store_backend" json:"store_backend"`
+	SQLitePath     string `yaml:"sqlite_path" json:"sqlite_path"`
+	DatabaseURL    string `yaml:"database_url" json:"database_url"`
+	DBMaxOpenConns int    `yaml:"db_max_open_conns" json:"db_max_open_conns"`
+	DBMaxIdleConns int    `yaml:"db_max_idle_conns" json:"db_max_idle_conns"`
+
+	StatusCacheTTL  time.Duration `yaml:"status_cache_ttl_ms" json:"status_cache_ttl_ms"`
+	ProjectCacheTTL time.Duration `yaml:"project_cache_ttl_seconds" json:"project_cache_ttl_seconds"`
+
+	HistoryRetention time.Duration `yaml:"history_retention_hours" json:"history_retention_hours"`
+	CheckInterval    time.Duration `yaml:"check_interval_seconds" json:"check_interval_seconds"`
+	CheckJitter      float64       `yaml:"check_jitter_percent" json:"check_jitter_percent"`
+	// After BackoffFailures consecutive DOWN checks (0 = never) the scheduler
+	// doubles a project's interval per further failure, up to BackoffMax.
+	BackoffFailures int           `yaml:"check_backoff_after_failures" json:"check_backoff_after_failures"`
+	BackoffMax      time.Duration `yaml:"check_backoff_max_minutes" json:"check_backoff_max_minutes"`
+
+	LogLevel slog.Level `yaml:"log_level" json:"log_level"`
+
+	SMTPHost            string        `yaml:"smtp_host" json:"smtp_host"`
+	SMTPPort            string        `yaml:"smtp_port" json:"smtp_port"`
+	SMTPUser            string        `yaml:"smtp_user" json:"smtp_user"`
+	SMTPPassword        string        `yaml:"smtp_password" json:"smtp_password"`
+	SMTPFrom            string        `yaml:"smtp_from" json:"smtp_from"`
+	EmailSuppressWindow time.Duration `yaml:"email_suppress_minutes" json:"email_suppress_minutes"`
+
+	APIKey        string        `yaml:"api_key" json:"api_key"`
+	APIRateLimit  int           `yaml:"api_rate_limit" json:"api_rate_limit"`
+	APIRateWindow time.Duration `yaml:"api_rate_window_ms" json:"api_rate_window_ms"`
+
+	// IPAllowlist restricts the auth and admin endpoints to these networks;
+	// empty allows everyone.
+	IPAllowlist []*net.IPNet `yaml:"ip_allowlist" json:"ip_allowlist"`
+	// TrustedProxies lists the proxy IPs or CIDR blocks whose X-Forwarded-For
+	// is believed, read at startup; empty uses the connection's address.
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies"`
+
+	// DebugToken enables /debug/store when set at startup.
+	DebugToken string `yaml:"debug_token" json:"debug_token"`
+
+	// SupabaseServiceRoleKey enables the project management endpoints.
+	SupabaseServiceRoleKey string `yaml:"supabase_service_role_key" json:"supabase_service_role_key"`
+
+	SupabaseCBFailures int           `yaml:"supabase_cb_failures" json:"supabase_cb_failures"`
+	SupabaseCBTimeout  time.Duration `yaml:"supabase_cb_timeout_s" json:"supabase_cb_timeout_s"`
+
+	AnomalyK          float64 `yaml:"anomaly_stddev_k" json:"anomaly_stddev_k"`
+	AnomalyWindow     int     `yaml:"anomaly_window" json:"anomaly_window"`
+	AnomalyAlertAfter int     `yaml:"anomaly_alert_after" json:"anomaly_alert_after"`
+
+	// SelfCheckThreshold is the fraction of projects failing in one cycle that
+	// is treated as heartbeat itself losing connectivity (0 disables).
+	SelfCheckThreshold float64 `yaml:"self_check_threshold" json:"self_check_threshold"`
+
+	// SLATarget is the uptime percentage used for projects without their own
+	// sla_target; 0 means they report no target.
+	SLATarget float64 `yaml:"sla_target" json:"sla_target"`
+
+	// RedisStreamURL, when set, mirrors every check result to a Redis stream.
+	RedisStreamURL    string `yaml:"redis_stream_url" json:"redis_stream_url"`
+	RedisStreamKey    string `yaml:"redis_stream_key" json:"redis_stream_key"`
+	RedisStreamMaxLen int64  `yaml:"redis_stream_max_len" json:"redis_stream_max_len"`
+}
+
+func loadConfig(configFile string) (Config, error) {
 	loadDotEnvIfPresent(".env")
 	// Allow running from repo root (where backend/.env exists).
 	if _, err := os.Stat(".env"); err != nil {
 		loadDotEnvIfPresent("backend/.env")
 	}
+	if configFile == "" {
+		configFile = strings.TrimSpace(os.Getenv("CONFIG_FILE"))
+	}
+	if configFile != "" {
+		if err := loadConfigFile(configFile); err != nil {
+			return Config{}, err
+		}
+	}
 	cfg := Config{
-		Port:       os.Getenv("PORT"),
-		CORSOrigin: os.Getenv("CORS_ORIGIN"),
+		Port:        os.Getenv("PORT"),
+		CORSOrigins: splitList(os.Getenv("CORS_ORIGIN")),
 	}
 	if cfg.Port == "" {
 		cfg.Port = "8080"
 	}
-	if cfg.CORSOrigin == "" {
-		cfg.CORSOrigin = "*"
+	if len(cfg.CORSOrigins) == 0 {
+		cfg.CORSOrigins = []string{"*"}
+	}
+	for i, o := range cfg.CORSOrigins {
+		cfg.CORSOrigins[i] = strings.TrimRight(o, "/")
 	}
 
 	cfg.SupabaseURL = os.Getenv("SUPABASE_URL")
@@ -64,6 +211,7 @@ func loadConfig() (Config, error) {
 	if cfg.SupabaseURL == "" || cfg.SupabaseAnonKey == "" {
 		return Config{}, fmt.Errorf("missing SUPABASE_URL or SUPABASE_ANON_KEY")
 	}
+	cfg.SupabaseServiceRoleKey = strings.TrimSpace(os.Getenv("SUPABASE_SERVICE_ROLE_KEY"))
 
 	timeoutMsStr := os.Getenv("PING_TIMEOUT_MS")
 	if timeoutMsStr == "" {
@@ -98,6 +246,59 @@ func loadConfig() (Config, error) {
 		cfg.PingRetryDelay = time.Duration(delayMs) * time.Millisecond
 	}
 
+	cfg.PingUserAgent = strings.TrimSpace(os.Getenv("PING_USER_AGENT"))
+	if cfg.PingUserAgent == "" {
+		cfg.PingUserAgent = "heartbeat/1.0"
+	}
+
+	maxBodyStr := strings.TrimSpace(os.Getenv("PING_MAX_BODY_BYTES"))
+	if maxBodyStr == "" {
+		cfg.PingMaxBodyBytes = 65536
+	} else {
+		n, err := strconv.ParseInt(maxBodyStr, 10, 64)
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("invalid PING_MAX_BODY_BYTES")
+		}
+		cfg.PingMaxBodyBytes = n
+	}
+	if v := strings.TrimSpace(os.Getenv("PING_FORCE_HTTP2")); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid PING_FORCE_HTTP2")
+		}
+		cfg.PingForceHTTP2 = b
+	}
+	cfg.ICMPCount = 3
+	if v := strings.TrimSpace(os.Getenv("ICMP_COUNT")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxICMPCount {
+			return Config{}, fmt.Errorf("invalid ICMP_COUNT")
+		}
+		cfg.ICMPCount = n
+	}
+	switch v := strings.TrimSpace(os.Getenv("MIN_TLS_VERSION")); v {
+	case "":
+	case "1.0":
+		cfg.PingMinTLS = tls.VersionTLS10
+	case "1.1":
+		cfg.PingMinTLS = tls.VersionTLS11
+	case "1.2":
+		cfg.PingMinTLS = tls.VersionTLS12
+	case "1.3":
+		cfg.PingMinTLS = tls.VersionTLS13
+	default:
+		return Config{}, fmt.Errorf("invalid MIN_TLS_VERSION")
+	}
+
+	cfg.PingRetryBackoff = strings.ToLower(strings.TrimSpace(os.Getenv("PING_RETRY_BACKOFF")))
+	switch cfg.PingRetryBackoff {
+	case "":
+		cfg.PingRetryBackoff = "fixed"
+	case "fixed", "exponential":
+	default:
+		return Config{}, fmt.Errorf("invalid PING_RETRY_BACKOFF")
+	}
+
 	degradedStr := os.Getenv("DEGRADED_LATENCY_MS")
 	if degradedStr == "" {
 		cfg.DegradedMs = 1200
@@ -108,10 +309,79 @@ func loadConfig() (Config, error) {
 		}
 		cfg.DegradedMs = int64(ms)
 	}
+	if slowStr := strings.TrimSpace(os.Getenv("SLOW_LATENCY_MS")); slowStr != "" {
+		ms, err := strconv.Atoi(slowStr)
+		if err != nil || ms < 0 {
+			return Config{}, fmt.Errorf("invalid SLOW_LATENCY_MS")
+		}
+		cfg.SlowMs = int64(ms)
+	}
+
+	failStr := strings.TrimSpace(os.Getenv("FAILURE_THRESHOLD"))
+	if failStr == "" {
+		cfg.FailureThreshold = 1
+	} else {
+		n, err := strconv.Atoi(failStr)
+		if err != nil || n < 1 || n > 100 {
+			return Config{}, fmt.Errorf("invalid FAILURE_THRESHOLD")
+		}
+		cfg.FailureThreshold = n
+	}
+
+	recoveryStr := strings.TrimSpace(os.Getenv("RECOVERY_THRESHOLD"))
+	if recoveryStr == "" {
+		cfg.RecoveryThreshold = 1
+	} else {
+		n, err := strconv.Atoi(recoveryStr)
+		if err != nil || n < 1 || n > 100 {
+			return Config{}, fmt.Errorf("invalid RECOVERY_THRESHOLD")
+		}
+		cfg.RecoveryThreshold = n
+	}
 
 	cfg.WebhookURL = strings.TrimSpace(os.Getenv("WEBHOOK_URL"))
+	cfg.AlertWebhookURL = strings.TrimSpace(os.Getenv("ALERT_WEBHOOK_URL"))
+	cfg.RecoveryWebhookURL = strings.TrimSpace(os.Getenv("RECOVERY_WEBHOOK_URL"))
+	cfg.WebhookTemplate = os.Getenv("WEBHOOK_TEMPLATE")
+	if strings.TrimSpace(cfg.WebhookTemplate) != "" {
+		// Render a sample so unknown fields fail now instead of at alert time.
+		if _, err := renderWebhookTemplate(cfg.WebhookTemplate, webhookPayload(Incident{}, time.UTC)); err != nil {
+			return Config{}, fmt.Errorf("invalid WEBHOOK_TEMPLATE: %w", err)
+		}
+	}
+	cfg.WebhookContentType = strings.TrimSpace(os.Getenv("WEBHOOK_CONTENT_TYPE"))
+	if cfg.WebhookContentType == "" {
+		cfg.WebhookContentType = "application/json"
+	}
+	cfg.WebhookFormat = strings.ToLower(strings.TrimSpace(os.Getenv("WEBHOOK_FORMAT")))
+	if cfg.WebhookFormat == "" {
+		cfg.WebhookFormat = "default"
+	} else if cfg.WebhookFormat != "default" && cfg.WebhookFormat != "cloudevents" {
+		return Config{}, fmt.Errorf("invalid WEBHOOK_FORMAT")
+	}
+	cfg.MinNotifySeverity = strings.ToLower(strings.TrimSpace(os.Getenv("MIN_NOTIFY_SEVERITY")))
+	if cfg.MinNotifySeverity == "" {
+		cfg.MinNotifySeverity = "info"
+	} else if severityRank(cfg.MinNotifySeverity) == 0 {
+		return Config{}, fmt.Errorf("invalid MIN_NOTIFY_SEVERITY")
+	}
+	if v := strings.TrimSpace(os.Getenv("ESCALATION_INTERVAL_MINUTES")); v != "" {
+		mins, err := strconv.Atoi(v)
+		if err != nil || mins < 0 {
+			return Config{}, fmt.Errorf("invalid ESCALATION_INTERVAL_MINUTES")
+		}
+		cfg.EscalationInterval = time.Duration(mins) * time.Minute
+	}
+	loc, err := time.LoadLocation(strings.TrimSpace(os.Getenv("DISPLAY_TIMEZONE")))
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid DISPLAY_TIMEZONE: %w", err)
+	}
+	cfg.DisplayTimezone = loc
 	cfg.SlackWebhookURL = strings.TrimSpace(os.Getenv("SLACK_WEBHOOK_URL"))
 	cfg.DiscordWebhookURL = strings.TrimSpace(os.Getenv("DISCORD_WEBHOOK_URL"))
+	cfg.TeamsWebhookURL = strings.TrimSpace(os.Getenv("TEAMS_WEBHOOK_URL"))
+	cfg.TelegramBotToken = strings.TrimSpace(os.Getenv("TELEGRAM_BOT_TOKEN"))
+	cfg.TelegramChatID = strings.TrimSpace(os.Getenv("TELEGRAM_CHAT_ID"))
 
 	cfg.ConfirmBaseURL = strings.TrimRight(strings.TrimSpace(os.Getenv("CONFIRM_BASE_URL")), "/")
 	if cfg.ConfirmBaseURL == "" {
@@ -121,10 +391,25 @@ func loadConfig() (Config, error) {
 	if cfg.ConfirmTokenSecret == "" {
 		cfg.ConfirmTokenSecret = "dev-only-change-me"
 	}
+	cfg.ConfirmTokenSecretsOld = splitList(os.Getenv("CONFIRM_TOKEN_SECRET_OLD"))
 	cfg.ConfirmStorePath = strings.TrimSpace(os.Getenv("CONFIRM_STORE_PATH"))
 	if cfg.ConfirmStorePath == "" {
 		cfg.ConfirmStorePath = ".confirm_store.json"
 	}
+	cfg.ConfirmWALPath = strings.TrimSpace(os.Getenv("CONFIRM_WAL_PATH"))
+	if cfg.ConfirmWALPath == "" {
+		cfg.ConfirmWALPath = cfg.ConfirmStorePath + ".wal"
+	}
+	compactionStr := strings.TrimSpace(os.Getenv("CONFIRM_COMPACTION_HOURS"))
+	if compactionStr == "" {
+		cfg.ConfirmCompaction = 24 * time.Hour
+	} else {
+		hours, err := strconv.Atoi(compactionStr)
+		if err != nil || hours <= 0 {
+			return Config{}, fmt.Errorf("invalid CONFIRM_COMPACTION_HOURS")
+		}
+		cfg.ConfirmCompaction = time.Duration(hours) * time.Hour
+	}
 	ttlStr := strings.TrimSpace(os.Getenv("CONFIRM_TOKEN_TTL_MINUTES"))
 	if ttlStr == "" {
 		cfg.ConfirmTokenTTLMinutes = 30
@@ -136,39 +421,592 @@ func loadConfig() (Config, error) {
 		cfg.ConfirmTokenTTLMinutes = ttl
 	}
 
+	// CONFIRM_EXPIRY_DAYS is accepted as an alias.
+	retentionKey := "CONFIRM_RETENTION_DAYS"
+	retentionStr := strings.TrimSpace(os.Getenv(retentionKey))
+	if retentionStr == "" {
+		retentionKey = "CONFIRM_EXPIRY_DAYS"
+		retentionStr = strings.TrimSpace(os.Getenv(retentionKey))
+	}
+	if retentionStr != "" {
+		days, err := strconv.Atoi(retentionStr)
+		if err != nil || days < 0 {
+			return Config{}, fmt.Errorf("invalid %s", retentionKey)
+		}
+		cfg.ConfirmRetentionDays = days
+	}
+
 	cfg.EmailJSServiceID = strings.TrimSpace(os.Getenv("EMAILJS_SERVICE_ID"))
 	cfg.EmailJSTemplateID = strings.TrimSpace(os.Getenv("EMAILJS_TEMPLATE_ID"))
 	cfg.EmailJSPublicKey = strings.TrimSpace(os.Getenv("EMAILJS_PUBLIC_KEY"))
 	cfg.EmailJSPrivateKey = strings.TrimSpace(os.Getenv("EMAILJS_PRIVATE_KEY"))
+
+	sweepStr := strings.TrimSpace(os.Getenv("RATE_LIMIT_SWEEP_SECONDS"))
+	if sweepStr == "" {
+		cfg.RateLimitSweepInterval = 5 * time.Minute
+	} else {
+		secs, err := strconv.Atoi(sweepStr)
+		if err != nil || secs < 0 {
+			return Config{}, fmt.Errorf("invalid RATE_LIMIT_SWEEP_SECONDS")
+		}
+		cfg.RateLimitSweepInterval = time.Duration(secs) * time.Second
+	}
+	cfg.RateLimitAlgo = strings.ToLower(strings.TrimSpace(os.Getenv("RATE_LIMIT_ALGO")))
+	switch cfg.RateLimitAlgo {
+	case "":
+		cfg.RateLimitAlgo = "sliding"
+	case "sliding", "token_bucket":
+	default:
+		return Config{}, fmt.Errorf("invalid RATE_LIMIT_ALGO")
+	}
+
+	cfg.DatabaseURL = strings.TrimSpace(os.Getenv("DATABASE_URL"))
+	cfg.StoreBackend = strings.ToLower(strings.TrimSpace(os.Getenv("STORE_BACKEND")))
+	if cfg.StoreBackend == "" {
+		cfg.StoreBackend = "memory"
+		if cfg.DatabaseURL != "" {
+			cfg.StoreBackend = "postgres"
+		}
+	}
+	if cfg.StoreBackend != "memory" && cfg.StoreBackend != "sqlite" && cfg.StoreBackend != "postgres" {
+		return Config{}, fmt.Errorf("invalid STORE_BACKEND")
+	}
+	if cfg.StoreBackend == "postgres" && cfg.DatabaseURL == "" {
+		return Config{}, fmt.Errorf("STORE_BACKEND=postgres requires DATABASE_URL")
+	}
+	for _, pool := range []struct {
+		key string
+		dst *int
+		def int
+	}{
+		{"DB_MAX_OPEN_CONNS", &cfg.DBMaxOpenConns, 10},
+		{"DB_MAX_IDLE_CONNS", &cfg.DBMaxIdleConns, 5},
+	} {
+		*pool.dst = pool.def
+		if v := strings.TrimSpace(os.Getenv(pool.key)); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return Config{}, fmt.Errorf("invalid %s", pool.key)
+			}
+			*pool.dst = n
+		}
+	}
+	cfg.SQLitePath = strings.TrimSpace(os.Getenv("SQLITE_PATH"))
+	if cfg.SQLitePath == "" {
+		cfg.SQLitePath = "heartbeat.db"
+	}
+
+	if v := strings.TrimSpace(os.Getenv("HISTORY_RETENTION_HOURS")); v != "" {
+		hours, err := strconv.Atoi(v)
+		if err != nil || hours < 0 {
+			return Config{}, fmt.Errorf("invalid HISTORY_RETENTION_HOURS")
+		}
+		cfg.HistoryRetention = time.Duration(hours) * time.Hour
+	}
+
+	cfg.CheckInterval = 60 * time.Second
+	if v := strings.TrimSpace(os.Getenv("CHECK_INTERVAL_SECONDS")); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs < 0 {
+			return Config{}, fmt.Errorf("invalid CHECK_INTERVAL_SECONDS")
+		}
+		cfg.CheckInterval = time.Duration(secs) * time.Second
+	}
+	cfg.CheckJitter = 0.1
+	if v := strings.TrimSpace(os.Getenv("CHECK_JITTER_PERCENT")); v != "" {
+		pct, err := strconv.Atoi(v)
+		if err != nil || pct < 0 || pct > 50 {
+			return Config{}, fmt.Errorf("invalid CHECK_JITTER_PERCENT")
+		}
+		cfg.CheckJitter = float64(pct) / 100
+	}
+	if v := strings.TrimSpace(os.Getenv("CHECK_BACKOFF_AFTER_FAILURES")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("invalid CHECK_BACKOFF_AFTER_FAILURES")
+		}
+		cfg.BackoffFailures = n
+	}
+	cfg.BackoffMax = 30 * time.Minute
+	if v := strings.TrimSpace(os.Getenv("CHECK_BACKOFF_MAX_MINUTES")); v != "" {
+		mins, err := strconv.Atoi(v)
+		if err != nil || mins < 1 {
+			return Config{}, fmt.Errorf("invalid CHECK_BACKOFF_MAX_MINUTES")
+		}
+		cfg.BackoffMax = time.Duration(mins) * time.Minute
+	}
+
+	cacheStr := strings.TrimSpace(os.Getenv("STATUS_CACHE_TTL_MS"))
+	if cacheStr == "" {
+		cfg.StatusCacheTTL = 5 * time.Second
+	} else {
+		ms, err := strconv.Atoi(cacheStr)
+		if err != nil || ms < 0 {
+			return Config{}, fmt.Errorf("invalid STATUS_CACHE_TTL_MS")
+		}
+		cfg.StatusCacheTTL = time.Duration(ms) * time.Millisecond
+	}
+	projectCacheStr := strings.TrimSpace(os.Getenv("PROJECT_CACHE_TTL_SECONDS"))
+	if projectCacheStr == "" {
+		cfg.ProjectCacheTTL = 30 * time.Second
+	} else {
+		secs, err := strconv.Atoi(projectCacheStr)
+		if err != nil || secs < 0 {
+			return Config{}, fmt.Errorf("invalid PROJECT_CACHE_TTL_SECONDS")
+		}
+		cfg.ProjectCacheTTL = time.Duration(secs) * time.Second
+	}
+
+	cfg.SMTPHost = strings.TrimSpace(os.Getenv("SMTP_HOST"))
+	cfg.SMTPPort = strings.TrimSpace(os.Getenv("SMTP_PORT"))
+	if cfg.SMTPPort == "" {
+		cfg.SMTPPort = "587"
+	}
+	cfg.SMTPUser = strings.TrimSpace(os.Getenv("SMTP_USER"))
+	cfg.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+	cfg.SMTPFrom = strings.TrimSpace(os.Getenv("SMTP_FROM"))
+	if cfg.SMTPHost != "" && cfg.SMTPFrom == "" {
+		return Config{}, fmt.Errorf("SMTP_FROM is required when SMTP_HOST is set")
+	}
+	suppressStr := strings.TrimSpace(os.Getenv("EMAIL_SUPPRESS_MINUTES"))
+	if suppressStr == "" {
+		cfg.EmailSuppressWindow = 15 * time.Minute
+	} else {
+		mins, err := strconv.Atoi(suppressStr)
+		if err != nil || mins < 0 {
+			return Config{}, fmt.Errorf("invalid EMAIL_SUPPRESS_MINUTES")
+		}
+		cfg.EmailSuppressWindow = time.Duration(mins) * time.Minute
+	}
+
+	switch strings.ToLower(strings.TrimSpace(os.Getenv("LOG_LEVEL"))) {
+	case "", "info":
+		cfg.LogLevel = slog.LevelInfo
+	case "debug":
+		cfg.LogLevel = slog.LevelDebug
+	case "warn", "warning":
+		cfg.LogLevel = slog.LevelWarn
+	case "error":
+		cfg.LogLevel = slog.LevelError
+	default:
+		return Config{}, fmt.Errorf("invalid LOG_LEVEL")
+	}
+
+	cfg.APIKey = strings.TrimSpace(os.Getenv("API_KEY"))
+	for _, block := range splitList(os.Getenv("IP_ALLOWLIST")) {
+		_, ipNet, err := net.ParseCIDR(block)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid IP_ALLOWLIST entry %q", block)
+		}
+		cfg.IPAllowlist = append(cfg.IPAllowlist, ipNet)
+	}
+	for _, proxy := range splitList(os.Getenv("TRUSTED_PROXIES")) {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return Config{}, fmt.Errorf("invalid TRUSTED_PROXIES entry %q", proxy)
+			}
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, proxy)
+	}
+	cfg.DebugToken = strings.TrimSpace(os.Getenv("DEBUG_TOKEN"))
+	if v := strings.TrimSpace(os.Getenv("API_RATE_LIMIT")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("invalid API_RATE_LIMIT")
+		}
+		cfg.APIRateLimit = n
+	}
+	rateWindowStr := strings.TrimSpace(os.Getenv("API_RATE_WINDOW_MS"))
+	if rateWindowStr == "" {
+		cfg.APIRateWindow = time.Minute
+	} else {
+		ms, err := strconv.Atoi(rateWindowStr)
+		if err != nil || ms <= 0 {
+			return Config{}, fmt.Errorf("invalid API_RATE_WINDOW_MS")
+		}
+		cfg.APIRateWindow = time.Duration(ms) * time.Millisecond
+	}
+
+	cbFailuresStr := strings.TrimSpace(os.Getenv("SUPABASE_CB_FAILURES"))
+	if cbFailuresStr == "" {
+		cfg.SupabaseCBFailures = 5
+	} else {
+		n, err := strconv.Atoi(cbFailuresStr)
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("invalid SUPABASE_CB_FAILURES")
+		}
+		cfg.SupabaseCBFailures = n
+	}
+	cbTimeoutStr := strings.TrimSpace(os.Getenv("SUPABASE_CB_TIMEOUT_S"))
+	if cbTimeoutStr == "" {
+		cfg.SupabaseCBTimeout = 60 * time.Second
+	} else {
+		secs, err := strconv.Atoi(cbTimeoutStr)
+		if err != nil || secs <= 0 {
+			return Config{}, fmt.Errorf("invalid SUPABASE_CB_TIMEOUT_S")
+		}
+		cfg.SupabaseCBTimeout = time.Duration(secs) * time.Second
+	}
+
+	anomalyKStr := strings.TrimSpace(os.Getenv("ANOMALY_STDDEV_K"))
+	if anomalyKStr == "" {
+		cfg.AnomalyK = 3
+	} else {
+		k, err := strconv.ParseFloat(anomalyKStr, 64)
+		if err != nil || k < 0 {
+			return Config{}, fmt.Errorf("invalid ANOMALY_STDDEV_K")
+		}
+		cfg.AnomalyK = k
+	}
+	anomalyWindowStr := strings.TrimSpace(os.Getenv("ANOMALY_WINDOW"))
+	if anomalyWindowStr == "" {
+		cfg.AnomalyWindow = 20
+	} else {
+		n, err := strconv.Atoi(anomalyWindowStr)
+		if err != nil || n < minAnomalyBaseline || n > maxHistoryPerProject {
+			return Config{}, fmt.Errorf("invalid ANOMALY_WINDOW")
+		}
+		cfg.AnomalyWindow = n
+	}
+	if v := strings.TrimSpace(os.Getenv("ANOMALY_ALERT_AFTER")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("invalid ANOMALY_ALERT_AFTER")
+		}
+		cfg.AnomalyAlertAfter = n
+	}
+
+	selfCheckStr := strings.TrimSpace(os.Getenv("SELF_CHECK_THRESHOLD"))
+	if selfCheckStr == "" {
+		cfg.SelfCheckThreshold = 1
+	} else {
+		f, err := strconv.ParseFloat(selfCheckStr, 64)
+		if err != nil || f < 0 || f > 1 {
+			return Config{}, fmt.Errorf("invalid SELF_CHECK_THRESHOLD")
+		}
+		cfg.SelfCheckThreshold = f
+	}
+
+	if v := strings.TrimSpace(os.Getenv("SLA_TARGET")); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !validSLATarget(f) {
+			return Config{}, fmt.Errorf("invalid SLA_TARGET")
+		}
+		cfg.SLATarget = f
+	}
+
+	cfg.RedisStreamURL = strings.TrimSpace(os.Getenv("REDIS_STREAM_URL"))
+	if cfg.RedisStreamURL != "" {
+		if _, err := redis.ParseURL(cfg.RedisStreamURL); err != nil {
+			return Config{}, fmt.Errorf("invalid REDIS_STREAM_URL")
+		}
+	}
+	cfg.RedisStreamKey = strings.TrimSpace(os.Getenv("REDIS_STREAM_KEY"))
+	if cfg.RedisStreamKey == "" {
+		cfg.RedisStreamKey = "heartbeat:checks"
+	}
+	if v := strings.TrimSpace(os.Getenv("REDIS_STREAM_MAX_LEN")); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return Config{}, fmt.Errorf("invalid REDIS_STREAM_MAX_LEN")
+		}
+		cfg.RedisStreamMaxLen = n
+	}
 	return cfg, nil
 }
 
+// loadConfigFile reads a YAML or JSON file of settings keyed by Config's tags
+// and exports them as env vars that aren't already set, so the usual parsing
+// and validation below apply and real env vars keep precedence.
+func loadConfigFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	var raw map[string]any
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(b, &raw)
+	} else {
+		err = yaml.Unmarshal(b, &raw)
+	}
+	if err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	known := make(map[string]bool)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		known[t.Field(i).Tag.Get("yaml")] = true
+	}
+	for key, v := range raw {
+		if !known[key] {
+			return fmt.Errorf("config file %s: unknown key %q", path, key)
+		}
+		var val string
+		switch x := v.(type) {
+		case nil:
+			continue
+		case float64:
+			// JSON numbers decode as float64; avoid exponent notation.
+			val = strconv.FormatFloat(x, 'f', -1, 64)
+		case string, bool, int, int64, uint64:
+			val = fmt.Sprint(x)
+		case []any:
+			parts := make([]string, len(x))
+			for i, item := range x {
+				parts[i] = fmt.Sprint(item)
+			}
+			val = strings.Join(parts, ",")
+		default:
+			return fmt.Errorf("config file %s: key %q must be a scalar or list", path, key)
+		}
+		env := strings.ToUpper(key)
+		if _, exists := os.LookupEnv(env); exists {
+			continue
+		}
+		setLoadedEnv(env, val)
+	}
+	return nil
+}
+
+// splitList splits a comma-separated env value, dropping empty entries.
+func splitList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if v := strings.TrimSpace(part); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// loadedEnvKeys remembers which env vars came from .env or CONFIG_FILE rather
+// than the real environment, so a reload can clear and re-read them.
+var loadedEnvKeys = map[string]bool{}
+
+func setLoadedEnv(key, val string) {
+	_ = os.Setenv(key, val)
+	loadedEnvKeys[key] = true
+}
+
+// reloadConfig re-reads .env, the config file and the environment from
+// scratch. It must not run concurrently with loadConfig.
+func reloadConfig(configFile string) (Config, error) {
+	for key := range loadedEnvKeys {
+		_ = os.Unsetenv(key)
+		delete(loadedEnvKeys, key)
+	}
+	return loadConfig(configFile)
+}
+
+// liveConfig holds the running configuration. Readers take a snapshot via get;
+// a SIGHUP reload swaps in a new one.
+type liveConfig struct {
+	mu  sync.RWMutex
+	cfg *Config
+}
+
+func (l *liveConfig) get() Config {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return *l.cfg
+}
+
+func (l *liveConfig) set(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = &cfg
+}
+
+// keepStartupOnlySettings copies settings that are only read at startup from
+// the running config into next, warning about any that were changed.
+func keepStartupOnlySettings(logger *slog.Logger, running Config, next *Config) {
+	warn := func(key string, changed bool) {
+		if changed {
+			logger.Warn("config change requires restart; keeping running value", "setting", key)
+		}
+	}
+	warn("PORT", next.Port != running.Port)
+	warn("CONFIRM_STORE_PATH", next.ConfirmStorePath != running.ConfirmStorePath)
+	warn("CONFIRM_WAL_PATH", next.ConfirmWALPath != running.ConfirmWALPath)
+	warn("CONFIRM_COMPACTION_HOURS", next.ConfirmCompaction != running.ConfirmCompaction)
+	warn("RATE_LIMIT_SWEEP_SECONDS", next.RateLimitSweepInterval != running.RateLimitSweepInterval)
+	warn("STORE_BACKEND", next.StoreBackend != running.StoreBackend)
+	warn("SQLITE_PATH", next.SQLitePath != running.SQLitePath)
+	warn("DATABASE_URL", next.DatabaseURL != running.DatabaseURL)
+	warn("DEBUG_TOKEN", next.DebugToken != running.DebugToken)
+	warn("CHECK_INTERVAL_SECONDS", (next.CheckInterval > 0) != (running.CheckInterval > 0))
+	warn("DB_MAX_OPEN_CONNS", next.DBMaxOpenConns != running.DBMaxOpenConns)
+	warn("DB_MAX_IDLE_CONNS", next.DBMaxIdleConns != running.DBMaxIdleConns)
+	warn("PING_FORCE_HTTP2", next.PingForceHTTP2 != running.PingForceHTTP2)
+	warn("MIN_TLS_VERSION", next.PingMinTLS != running.PingMinTLS)
+	next.Port = running.Port
+	next.ConfirmStorePath = running.ConfirmStorePath
+	next.ConfirmWALPath = running.ConfirmWALPath
+	next.ConfirmCompaction = running.ConfirmCompaction
+	next.RateLimitSweepInterval = running.RateLimitSweepInterval
+	next.StoreBackend = running.StoreBackend
+	next.SQLitePath = running.SQLitePath
+	next.DatabaseURL = running.DatabaseURL
+	next.DebugToken = running.DebugToken
+	next.PingForceHTTP2 = running.PingForceHTTP2
+	next.PingMinTLS = running.PingMinTLS
+	// The scheduler can change pace live but is only started at boot.
+	if (next.CheckInterval > 0) != (running.CheckInterval > 0) {
+		next.CheckInterval = running.CheckInterval
+	}
+	next.DBMaxOpenConns = running.DBMaxOpenConns
+	next.DBMaxIdleConns = running.DBMaxIdleConns
+	warn("REDIS_STREAM_URL", next.RedisStreamURL != running.RedisStreamURL)
+	warn("REDIS_STREAM_KEY", next.RedisStreamKey != running.RedisStreamKey)
+	warn("REDIS_STREAM_MAX_LEN", next.RedisStreamMaxLen != running.RedisStreamMaxLen)
+	next.RedisStreamURL = running.RedisStreamURL
+	next.RedisStreamKey = running.RedisStreamKey
+	next.RedisStreamMaxLen = running.RedisStreamMaxLen
+}
+
 func loadDotEnvIfPresent(path string) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return
 	}
-	lines := strings.Split(string(b), "\n")
-	for _, line := range lines {
-		l := strings.TrimSpace(line)
+	for _, kv := range parseDotEnv(string(b)) {
+		if _, exists := os.LookupEnv(kv[0]); exists {
+			continue
+		}
+		setLoadedEnv(kv[0], kv[1])
+	}
+}
+
+// parseDotEnv returns the KEY=value pairs of a .env file in order. Values may
+// be single- or double-quoted (quoted values may span lines, and double
+// quotes understand \n, \" and \\), unquoted values drop inline comments
+// starting at " #" or " //", and a trailing backslash continues an unquoted
+// value on the next line. Unquoted and double-quoted values expand $VAR and
+// ${VAR} from the environment, then from earlier lines of the file; missing
+// variables expand to "". Single-quoted values are taken literally.
+func parseDotEnv(content string) [][2]string {
+	var out [][2]string
+	fileVals := map[string]string{}
+	lookup := func(name string) string {
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		return fileVals[name]
+	}
+	emit := func(key, val string) {
+		fileVals[key] = val
+		out = append(out, [2]string{key, val})
+	}
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		l := strings.TrimSpace(lines[i])
 		if l == "" || strings.HasPrefix(l, "#") {
 			continue
 		}
-		parts := strings.SplitN(l, "=", 2)
-		if len(parts) != 2 {
+		l = strings.TrimPrefix(l, "export ")
+		key, val, ok := strings.Cut(l, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
 			continue
 		}
-		key := strings.TrimSpace(parts[0])
-		val := strings.TrimSpace(parts[1])
-		val = strings.Trim(val, `"'`)
-		if key == "" {
+		val = strings.TrimLeft(val, " \t")
+
+		if val != "" && (val[0] == '"' || val[0] == '\'') {
+			quote := val[0]
+			rest := val[1:]
+			var sb strings.Builder
+			for closed := false; !closed; {
+				for j := 0; j < len(rest); j++ {
+					c := rest[j]
+					if c == quote {
+						closed = true
+						break
+					}
+					if quote == '"' && c == '$' {
+						if name, width := envRefName(rest[j+1:]); width > 0 {
+							sb.WriteString(lookup(name))
+							j += width
+							continue
+						}
+					}
+					if quote == '"' && c == '\\' && j+1 < len(rest) {
+						j++
+						switch rest[j] {
+						case 'n':
+							sb.WriteByte('\n')
+						case 't':
+							sb.WriteByte('\t')
+						default:
+							sb.WriteByte(rest[j])
+						}
+						continue
+					}
+					sb.WriteByte(c)
+				}
+				if closed || i+1 >= len(lines) {
+					break
+				}
+				// Unterminated quote: the value continues on the next line.
+				sb.WriteByte('\n')
+				i++
+				rest = lines[i]
+			}
+			emit(key, sb.String())
 			continue
 		}
-		if _, exists := os.LookupEnv(key); exists {
+
+		for strings.HasSuffix(val, "\\") && i+1 < len(lines) {
+			i++
+			val = strings.TrimSuffix(val, "\\") + strings.TrimSpace(lines[i])
+		}
+		for _, marker := range []string{" #", "\t#", " //", "\t//"} {
+			if idx := strings.Index(val, marker); idx >= 0 {
+				val = val[:idx]
+			}
+		}
+		emit(key, expandEnvRefs(strings.TrimSpace(val), lookup))
+	}
+	return out
+}
+
+// expandEnvRefs replaces each $VAR or ${VAR} in s with lookup(VAR). A "$" not
+// followed by a variable name is kept as is.
+func expandEnvRefs(s string, lookup func(string) string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '$' {
+			if name, width := envRefName(s[i+1:]); width > 0 {
+				sb.WriteString(lookup(name))
+				i += width
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// envRefName parses the variable name at the start of s, the text after a
+// "$": either {NAME} or a bare identifier. width is how many bytes of s the
+// reference used, 0 when there is none.
+func envRefName(s string) (name string, width int) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end <= 1 {
+			return "", 0
+		}
+		return s[1:end], end + 1
+	}
+	for width < len(s) {
+		c := s[width]
+		if c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (width > 0 && c >= '0' && c <= '9') {
+			width++
 			continue
 		}
-		_ = os.Setenv(key, val)
+		break
 	}
+	return s[:width], width
 }
 
 type Project struct {
@@ -177,14 +1015,189 @@ type Project struct {
 	URL     string `json:"url"`
 	Status  string `json:"status"`
 	Latency int64  `json:"latency"`
+	// ConsecutiveFailThreshold is the number of failed checks in a row needed
+	// before an incident is opened. Values below 1 use cfg.FailureThreshold.
+	ConsecutiveFailThreshold int `json:"min_failures_to_alert"`
+	// DegradedMs overrides cfg.DegradedMs for this project when > 0.
+	DegradedMs int64 `json:"degraded_ms"`
+	// SlowMs overrides cfg.SlowMs for this project when > 0.
+	SlowMs int64 `json:"slow_ms"`
+	// CheckIntervalSecs overrides cfg.CheckInterval for this project when > 0.
+	CheckIntervalSecs int `json:"check_interval_seconds"`
+	// SLATarget is the committed uptime percentage; 0 uses cfg.SLATarget.
+	SLATarget float64 `json:"sla_target"`
+	// TimeoutMs overrides cfg.PingTimeout for this project when > 0.
+	TimeoutMs int64 `json:"timeout_ms"`
+	// ICMPCount overrides cfg.ICMPCount for icmp:// projects when > 0.
+	ICMPCount int `json:"icmp_count"`
+	// Method is the HTTP method of the check, GET when empty. Body is sent
+	// with POST, PUT and PATCH checks, labelled with ContentType.
+	Method      string `json:"method,omitempty"`
+	Body        string `json:"body,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// Headers are extra request headers for HTTP checks.
+	Headers PingHeaders `json:"headers,omitempty"`
+	// Keyword, when set, must appear in the response body (or must not, with
+	// KeywordAbsent); KeywordRegex treats it as a regular expression.
+	Keyword       string `json:"keyword,omitempty"`
+	KeywordRegex  bool   `json:"keyword_regex,omitempty"`
+	KeywordAbsent bool   `json:"keyword_absent,omitempty"`
+	// Credentials authenticate pings against protected services. Rows
+	// without a credentials column fall back to basic_auth_user/_pass.
+	Credentials *Credentials `json:"credentials,omitempty"`
+	// FollowRedirects defaults to true when unset. When false a 3xx response
+	// is recorded as-is with the REDIRECT status and its Location. There are
+	// no per-project expected status codes: with redirects off every 3xx is
+	// REDIRECT, never HEALTHY.
+	FollowRedirects *bool    `json:"follow_redirects,omitempty"`
+	Tags            []string `json:"tags"`
+	// Enabled defaults to true when unset; disabled projects aren't pinged
+	// and report the DISABLED status.
+	Enabled *bool `json:"enabled,omitempty"`
+	// DeletedAt is set on soft-deleted rows, which are never monitored.
+	DeletedAt *string `json:"deleted_at,omitempty"`
+	// Stale is set when the project list came from the circuit breaker's
+	// cache because Supabase is unavailable.
+	Stale bool `json:"stale,omitempty"`
+	// LastHealthyAt is the TS of the project's last successful check, or null
+	// if it hasn't had one within the retained history.
+	LastHealthyAt *int64 `json:"lastHealthyAt"`
+}
+
+// newPingRequest builds one check attempt's request. It must be called per
+// attempt: a request body is a reader that the previous attempt consumed.
+func (p *Project) newPingRequest(target string) (*http.Request, error) {
+	method := strings.ToUpper(strings.TrimSpace(p.Method))
+	if method == "" {
+		method = "GET"
+	}
+	var body io.Reader
+	sendsBody := p.Body != "" && (method == "POST" || method == "PUT" || method == "PATCH")
+	if sendsBody {
+		body = strings.NewReader(p.Body)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if sendsBody {
+		contentType := p.ContentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		req.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range p.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+// isEnabled reports whether the project should be monitored.
+func (p *Project) isEnabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// followsRedirects reports whether pings should follow redirects.
+func (p *Project) followsRedirects() bool {
+	return p.FollowRedirects == nil || *p.FollowRedirects
+}
+
+// Credentials is read from the projects.credentials JSONB column. Type is
+// "basic" (Username/Password) or "bearer" (Token).
+type Credentials struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+}
+
+// PingHeaders is read from the projects.headers JSONB column.
+type PingHeaders map[string]string
+
+// MarshalJSON only exposes header names, since values often carry tokens.
+func (h PingHeaders) MarshalJSON() ([]byte, error) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return json.Marshal(names)
+}
+
+// MarshalJSON only exposes the credential type so secrets fetched from
+// Supabase are never echoed back through the API.
+func (c Credentials) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type string `json:"type"`
+	}{c.Type})
+}
+
+// apply sets the Authorization header for the credential type.
+func (c *Credentials) apply(req *http.Request) {
+	if c == nil {
+		return
+	}
+	switch strings.ToLower(c.Type) {
+	case "basic":
+		req.SetBasicAuth(c.Username, c.Password)
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+}
+
+// redact replaces any secret held by c that appears in msg.
+func (c *Credentials) redact(msg string) string {
+	if c == nil {
+		return msg
+	}
+	for _, secret := range []string{c.Password, c.Token} {
+		if secret != "" {
+			msg = strings.ReplaceAll(msg, secret, "[REDACTED]")
+		}
+	}
+	if c.Type == "basic" && c.Password != "" {
+		basic := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+		msg = strings.ReplaceAll(msg, basic, "[REDACTED]")
+	}
+	return msg
 }
 
 type CheckResult struct {
 	TS        int64  `json:"ts"`
 	Status    string `json:"status"`
 	LatencyMs int64  `json:"latency"`
+	// Phase breakdown of LatencyMs for HTTP checks; zero when not applicable.
+	// DNS, connect and TLS are also zero when a pooled connection was reused.
+	DNSMs     int64  `json:"dnsMs"`
+	ConnectMs int64  `json:"connectMs"`
+	TLSMs     int64  `json:"tlsMs"`
+	TTFBMs    int64  `json:"ttfbMs"`
 	Code      int    `json:"code"`
 	Error     string `json:"error,omitempty"`
+	// ErrorCategory refines a DOWN check's cause, e.g. "DNS_FAILURE".
+	ErrorCategory string `json:"errorCategory,omitempty"`
+	// Anomaly marks a latency far above the project's recent baseline.
+	Anomaly bool `json:"anomaly,omitempty"`
+	// BodyBytes is how much of the response body was read, capped at
+	// PING_MAX_BODY_BYTES; BodyTruncated is set when the body was longer.
+	BodyBytes     int64 `json:"bodyBytes"`
+	BodyTruncated bool  `json:"bodyTruncated,omitempty"`
+	// ContentType and ContentLength are the response's declared headers on
+	// successful HTTP checks; ContentLength is zero when not declared. Both
+	// are left empty for HEAD checks.
+	ContentType   string `json:"contentType,omitempty"`
+	ContentLength int64  `json:"contentLength,omitempty"`
+	// TLSVersion is the negotiated TLS version of a successful HTTPS check.
+	TLSVersion string `json:"tlsVersion,omitempty"`
+	// RedirectLocation is the Location of a REDIRECT check.
+	RedirectLocation string `json:"redirectLocation,omitempty"`
+	// Samples is the number of checks folded into a downsampled result.
+	Samples int `json:"samples,omitempty"`
 }
 
 type Incident struct {
@@ -193,392 +1206,4552 @@ type Incident struct {
 	ProjectID   string `json:"projectId"`
 	ProjectName string `json:"projectName"`
 	Status      string `json:"status"`
+	Severity    string `json:"severity"`
 	Message     string `json:"message"`
+	OpenedAt    int64  `json:"openedAt"`
+	ResolvedAt  int64  `json:"resolvedAt"`
+	// Acknowledged marks an open incident as being handled, which silences
+	// repeat notifications for it.
+	Acknowledged bool   `json:"acknowledged"`
+	AckedBy      string `json:"ackedBy,omitempty"`
+	AckedAt      int64  `json:"ackedAt,omitempty"`
 }
 
-func CORSMiddleware(origin string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, apikey, Authorization")
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
+// incidentSeverity maps an incident status to its severity: recoveries are
+// "info", outages "critical" and everything else "warning".
+func incidentSeverity(status string) string {
+	switch status {
+	case "HEALTHY":
+		return "info"
+	case "DOWN", "ISOLATED":
+		return "critical"
+	default:
+		return "warning"
+	}
+}
+
+// severityRank orders severities from least to most urgent; unknown ones
+// rank 0.
+func severityRank(severity string) int {
+	switch severity {
+	case "info":
+		return 1
+	case "warning":
+		return 2
+	case "critical":
+		return 3
+	default:
+		return 0
+	}
+}
+
+// DurationMs reports how long the incident lasted, or has lasted so far while
+// it is still open.
+func (i Incident) DurationMs() int64 {
+	end := i.ResolvedAt
+	if end == 0 {
+		end = time.Now().UnixMilli()
+	}
+	return end - i.OpenedAt
+}
+
+func (i Incident) MarshalJSON() ([]byte, error) {
+	type incidentJSON Incident
+	return json.Marshal(struct {
+		incidentJSON
+		DurationMs int64 `json:"durationMs"`
+	}{incidentJSON(i), i.DurationMs()})
+}
+
+func CORSMiddleware(origins []string) gin.HandlerFunc {
+	allowAll := false
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		if o == "*" {
+			allowAll = true
+		}
+		// Origins are compared case-insensitively.
+		allowed[strings.ToLower(o)] = true
+	}
+	return func(c *gin.Context) {
+		if allowAll {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			// The response depends on the request Origin, so caches must key on it.
+			c.Writer.Header().Add("Vary", "Origin")
+			if origin := c.GetHeader("Origin"); origin != "" && allowed[strings.ToLower(origin)] {
+				c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+				c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, apikey, Authorization, X-API-Key, X-Request-ID")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Supabase-Latency-Ms")
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(204)
+			return
+		}
+		c.Next()
+	}
+}
+
+// APIKeyMiddleware rejects requests that don't present key in X-API-Key or
+// as a Bearer token. An empty key leaves the route open.
+func APIKeyMiddleware(key string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasAPIKey(c, key) {
+			c.AbortWithStatusJSON(401, gin.H{"error": "invalid or missing API key"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// IPAllowlistMiddleware rejects clients whose IP isn't in one of the
+// networks with 403. An empty list allows everyone.
+func IPAllowlistMiddleware(allowed []*net.IPNet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(allowed) == 0 {
+			c.Next()
+			return
+		}
+		if ip := net.ParseIP(c.ClientIP()); ip != nil {
+			for _, n := range allowed {
+				if n.Contains(ip) {
+					c.Next()
+					return
+				}
+			}
+		}
+		c.AbortWithStatusJSON(403, gin.H{"error": "forbidden"})
+	}
+}
+
+// hasAPIKey reports whether the request carries key in X-API-Key or as a
+// bearer token. Any request passes when no key is configured.
+func hasAPIKey(c *gin.Context, key string) bool {
+	if key == "" {
+		return true
+	}
+	got := c.GetHeader("X-API-Key")
+	if got == "" {
+		if auth := c.GetHeader("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+			got = strings.TrimSpace(auth[7:])
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(key)) == 1
+}
+
+// requestIDHeader carries correlation IDs on API requests, pings and webhooks.
+const requestIDHeader = "X-Request-ID"
+
+// RequestIDMiddleware reuses a sane incoming X-Request-ID or generates one,
+// echoes it on the response and logs the request with it.
+func RequestIDMiddleware(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id, _ = randomNonce()
+		}
+		c.Set("requestID", id)
+		c.Header(requestIDHeader, id)
+		start := time.Now()
+		c.Next()
+		logger.Info("request", "request_id", id, "method", c.Request.Method, "path", c.Request.URL.Path,
+			"status", c.Writer.Status(), "duration_ms", time.Since(start).Milliseconds())
+	}
+}
+
+// validRequestID accepts short IDs of visible ASCII so callers can't inject
+// arbitrary text into logs and headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// RateLimitMiddleware allows limit requests per window for each route and
+// client IP pair, answering 429 with Retry-After beyond that. A limit of 0
+// disables it.
+func RateLimitMiddleware(store *Store, limit int, window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		info := store.allowAction("api:"+c.FullPath()+":"+c.ClientIP(), window, limit)
+		setRateLimitHeaders(c, info)
+		if !info.Allowed {
+			c.AbortWithStatusJSON(429, gin.H{"ok": false, "error": "too many requests"})
 			return
 		}
 		c.Next()
 	}
 }
 
+const (
+	maxHistoryPerProject = 500
+	maxIncidents         = 200
+
+	// backendWriteTimeout bounds each write-through statement, and
+	// historyTrimInterval is how often the backend's checks are trimmed
+	// to maxHistoryPerProject.
+	backendWriteTimeout = 5 * time.Second
+	historyTrimInterval = 5 * time.Minute
+)
+
 type Store struct {
 	mu              sync.Mutex
+	log             *slog.Logger
+	backend         storeBackend
 	historyByID     map[string][]CheckResult
 	lastStatusByID  map[string]string
+	projectNameByID map[string]string
+	projectTagsByID map[string][]string
+	// statusChanges records each project's raw check status changes, oldest
+	// first, for /status/diff; diffCursor is the last cursor it handed out
+	// and lastChangeSeq the highest statusChange.seq recorded.
+	statusChanges map[string][]statusChange
+	diffCursor    int64
+	lastChangeSeq int64
+	lastHealthyTS   map[string]int64
+	consecutiveFailCount map[string]int
+	consecutiveOKCount   map[string]int
+	failureThreshold     int
+	recoveryThreshold    int
+	historyRetention     time.Duration
+	consecutiveAnomalyCount map[string]int
+	anomalyK                float64
+	anomalyWindow           int
+	anomalyAlertAfter       int
+	isolatedSince           int64
+	// nextProbeAt is when a backed-off DOWN project may next be checked.
+	nextProbeAt map[string]time.Time
+	// lastReminder is when each DOWN project was last escalated (unix ms).
+	lastReminder     map[string]int64
 	incidents       []Incident
 	confirmedEmails map[string]int64
 	confirmStorePath string
+	confirmWALPath   string
+	confirmRetention time.Duration
 	rateBuckets     map[string][]int64
+	rateMaxWindow   time.Duration
+	rateAlgo        string
+	tokenBuckets    map[string]*TokenBucket
+	usedNonces      map[string]int64
+
+	statusSnapshot   []Project
+	statusSnapshotAt time.Time
+	statusFetchTime  time.Duration
+	statusInFlight   *statusRefresh
+	// statusGen is bumped by invalidateStatus; fetches that started under an
+	// older generation aren't cached.
+	statusGen uint64
+
+	projects projectCache
+
+	// scheduler is the background check registry.
+	scheduler *Scheduler
+	// checkStream mirrors check results to Redis when configured.
+	checkStream *redisStream
+	// backendWrites feeds runBackendWrites, which applies them to backend in
+	// order and off the lock.
+	backendWrites chan func(ctx context.Context)
+
+	summaryCache    *Summary
+	summaryCacheAt  time.Time
+	summaryCacheKey string
+}
+
+// statusRefresh is a ping cycle in progress; callers arriving meanwhile wait
+// on done and share its result.
+type statusRefresh struct {
+	done      chan struct{}
+	projects  []Project
+	fetchTime time.Duration
+	err       error
+}
+
+// projectCache holds the last project list fetched from Supabase for ttl.
+// A miss in progress is shared by concurrent callers through inFlight.
+type projectCache struct {
+	projects  []Project
+	fetchedAt time.Time
+	ttl       time.Duration
+	inFlight  *projectFetch
+}
+
+type projectFetch struct {
+	done     chan struct{}
+	projects []Project
+	stale    bool
+	err      error
 }
 
-func NewStore(cfg Config) *Store {
+func NewStore(cfg Config, logger *slog.Logger) (*Store, error) {
 	s := &Store{
+		log:            logger,
 		historyByID:    make(map[string][]CheckResult),
 		lastStatusByID: make(map[string]string),
+		projectNameByID: make(map[string]string),
+		projectTagsByID: make(map[string][]string),
+		statusChanges:   make(map[string][]statusChange),
+		lastHealthyTS:   make(map[string]int64),
+		consecutiveFailCount: make(map[string]int),
+		consecutiveOKCount:   make(map[string]int),
+		failureThreshold:     cfg.FailureThreshold,
+		recoveryThreshold:    cfg.RecoveryThreshold,
+		historyRetention:     cfg.HistoryRetention,
+		consecutiveAnomalyCount: make(map[string]int),
+		anomalyK:                cfg.AnomalyK,
+		anomalyWindow:           cfg.AnomalyWindow,
+		anomalyAlertAfter:       cfg.AnomalyAlertAfter,
+		nextProbeAt:             make(map[string]time.Time),
+		lastReminder:            make(map[string]int64),
 		confirmedEmails: make(map[string]int64),
 		confirmStorePath: cfg.ConfirmStorePath,
+		confirmWALPath:   cfg.ConfirmWALPath,
+		confirmRetention: time.Duration(cfg.ConfirmRetentionDays) * 24 * time.Hour,
 		rateBuckets:     make(map[string][]int64),
+		rateAlgo:        cfg.RateLimitAlgo,
+		tokenBuckets:    make(map[string]*TokenBucket),
+		usedNonces:      make(map[string]int64),
+		projects:        projectCache{ttl: cfg.ProjectCacheTTL},
+		scheduler:       NewScheduler(),
+	}
+	if cfg.StoreBackend != "memory" {
+		var backend *sqlBackend
+		var err error
+		if cfg.StoreBackend == "postgres" {
+			backend, err = openPostgresBackend(cfg.DatabaseURL, cfg.DBMaxOpenConns, cfg.DBMaxIdleConns)
+		} else {
+			backend, err = openSQLiteBackend(cfg.SQLitePath)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("open %s store: %w", cfg.StoreBackend, err)
+		}
+		if err := s.hydrate(backend); err != nil {
+			return nil, fmt.Errorf("load %s store: %w", cfg.StoreBackend, err)
+		}
+		s.useBackend(backend)
+	}
+	if cfg.RedisStreamURL != "" {
+		stream, err := newRedisStream(cfg.RedisStreamURL, cfg.RedisStreamKey, cfg.RedisStreamMaxLen, logger)
+		if err != nil {
+			return nil, fmt.Errorf("open redis stream: %w", err)
+		}
+		s.checkStream = stream
 	}
 	s.loadConfirmedFromDisk()
-	return s
+	if s.confirmStorePath != "" {
+		go s.compactConfirmedLoop(cfg.ConfirmCompaction)
+	}
+	if s.confirmRetention > 0 {
+		go s.sweepConfirmedLoop(s.confirmRetention / 10)
+	}
+	if cfg.RateLimitSweepInterval > 0 {
+		go s.sweepRateBucketsLoop(cfg.RateLimitSweepInterval)
+	}
+	go s.pruneNoncesLoop(10 * time.Minute)
+	return s, nil
 }
 
-func (s *Store) addCheck(project Project, check CheckResult) *Incident {
+// applyConfig updates the settings the Store copied from cfg at startup.
+func (s *Store) applyConfig(cfg Config) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.failureThreshold = cfg.FailureThreshold
+	s.recoveryThreshold = cfg.RecoveryThreshold
+	s.historyRetention = cfg.HistoryRetention
+	s.anomalyK = cfg.AnomalyK
+	s.anomalyWindow = cfg.AnomalyWindow
+	s.anomalyAlertAfter = cfg.AnomalyAlertAfter
+	s.confirmRetention = time.Duration(cfg.ConfirmRetentionDays) * 24 * time.Hour
+	s.rateAlgo = cfg.RateLimitAlgo
+	s.projects.ttl = cfg.ProjectCacheTTL
+}
 
-	existing := s.historyByID[project.ID]
-	existing = append(existing, check)
-	if len(existing) > 500 {
-		existing = existing[len(existing)-500:]
+// hydrate fills the in-memory history and incidents from a persistent backend
+// and restores each project's last known status so transitions are detected
+// across restarts.
+func (s *Store) hydrate(backend storeBackend) error {
+	history, err := backend.loadHistory(maxHistoryPerProject)
+	if err != nil {
+		return err
 	}
-	s.historyByID[project.ID] = existing
-
-	prevStatus, ok := s.lastStatusByID[project.ID]
-	s.lastStatusByID[project.ID] = check.Status
-	if ok && prevStatus != check.Status {
-		incident := Incident{
-			ID:          fmt.Sprintf("%d_%s_%s", time.Now().UnixMilli(), project.ID, check.Status),
-			TS:          time.Now().UnixMilli(),
-			ProjectID:   project.ID,
-			ProjectName: project.Name,
-			Status:      check.Status,
-			Message:     statusMessage(check.Status),
+	incidents, err := backend.loadIncidents(maxIncidents)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.historyByID = history
+	s.incidents = incidents
+	// Incidents stored before severities existed get theirs derived.
+	for i := range s.incidents {
+		if s.incidents[i].Severity == "" {
+			s.incidents[i].Severity = incidentSeverity(s.incidents[i].Status)
+		}
+	}
+	for id, checks := range history {
+		if len(checks) > 0 {
+			s.lastStatusByID[id] = checks[len(checks)-1].Status
+		}
+		for i := range checks {
+			if i == 0 || checks[i].Status != checks[i-1].Status {
+				s.recordStatusChangeLocked(id, checks[i])
+			}
+			if isUpStatus(checks[i].Status) {
+				s.lastHealthyTS[id] = checks[i].TS
+			}
 		}
-		s.incidents = append([]Incident{incident}, s.incidents...)
-		if len(s.incidents) > 200 {
-			s.incidents = s.incidents[:200]
+	}
+	for i := len(incidents) - 1; i >= 0; i-- {
+		if incidents[i].ResolvedAt == 0 {
+			s.lastStatusByID[incidents[i].ProjectID] = incidents[i].Status
 		}
-		return &incident
 	}
 	return nil
 }
 
-func statusMessage(status string) string {
-	switch status {
-	case "DOWN":
-		return "Service went DOWN"
-	case "HEALTHY":
-		return "Service recovered"
-	case "DEGRADED":
-		return "Service is DEGRADED"
-	default:
-		return "Status changed"
-	}
+// useBackend starts writing through to backend.
+func (s *Store) useBackend(backend storeBackend) {
+	s.backend = backend
+	s.backendWrites = make(chan func(ctx context.Context), 1024)
+	go s.runBackendWrites(historyTrimInterval)
 }
 
-func (s *Store) getHistory(projectID string, limit int) []CheckResult {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	h := s.historyByID[projectID]
-	if limit <= 0 || limit > len(h) {
-		limit = len(h)
-	}
-	out := make([]CheckResult, limit)
-	copy(out, h[len(h)-limit:])
-	return out
+// persistCheckLocked and persistIncidentLocked queue a write-through to the
+// backend, if any. Callers must hold s.mu so writes are queued in the order
+// they happened; the slow part runs in runBackendWrites.
+func (s *Store) persistCheckLocked(projectID string, check CheckResult) {
+	s.queueBackendWriteLocked("save check", func(ctx context.Context) {
+		if err := s.backend.saveCheck(ctx, projectID, check); err != nil {
+			s.log.Error("store: save check failed", "project_id", projectID, "error", err)
+		}
+	})
 }
 
-func (s *Store) getIncidents(limit int) []Incident {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if limit <= 0 || limit > len(s.incidents) {
-		limit = len(s.incidents)
-	}
-	out := make([]Incident, limit)
-	copy(out, s.incidents[:limit])
-	return out
+func (s *Store) persistIncidentLocked(incident Incident) {
+	s.queueBackendWriteLocked("save incident", func(ctx context.Context) {
+		if err := s.backend.saveIncident(ctx, incident); err != nil {
+			s.log.Error("store: save incident failed", "incident_id", incident.ID, "error", err)
+		}
+	})
 }
 
-func (s *Store) loadConfirmedFromDisk() {
-	if s.confirmStorePath == "" {
-		return
-	}
-	b, err := os.ReadFile(s.confirmStorePath)
-	if err != nil {
-		return
-	}
-	var m map[string]int64
-	if err := json.Unmarshal(b, &m); err != nil {
+// queueBackendWriteLocked drops the write rather than block the store when
+// the backend has fallen behind.
+func (s *Store) queueBackendWriteLocked(op string, write func(ctx context.Context)) {
+	if s.backend == nil {
 		return
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	for k, v := range m {
-		s.confirmedEmails[strings.ToLower(strings.TrimSpace(k))] = v
+	select {
+	case s.backendWrites <- write:
+	default:
+		s.log.Warn("store: write queue full; dropping write", "op", op)
 	}
 }
 
-func (s *Store) persistConfirmedToDiskLocked() {
-	if s.confirmStorePath == "" {
-		return
+// runBackendWrites applies queued writes one at a time, each under
+// backendWriteTimeout, and trims the stored history every trimEvery.
+func (s *Store) runBackendWrites(trimEvery time.Duration) {
+	ticker := time.NewTicker(trimEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case write := <-s.backendWrites:
+			ctx, cancel := context.WithTimeout(context.Background(), backendWriteTimeout)
+			write(ctx)
+			cancel()
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), backendWriteTimeout)
+			if err := s.backend.trimHistory(ctx, maxHistoryPerProject); err != nil {
+				s.log.Error("store: trim history failed", "error", err)
+			}
+			cancel()
+		}
 	}
-	tmp := s.confirmStorePath + ".tmp"
-	b, _ := json.MarshalIndent(s.confirmedEmails, "", "  ")
-	_ = os.WriteFile(tmp, b, 0o600)
-	_ = os.Rename(tmp, s.confirmStorePath)
 }
 
-func (s *Store) isConfirmed(email string) bool {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	_, ok := s.confirmedEmails[strings.ToLower(strings.TrimSpace(email))]
-	return ok
+// storeBackend persists checks and incidents so history survives restarts.
+// The Store keeps serving reads from its maps; a backend records every write
+// and hands the retained data back at startup.
+type storeBackend interface {
+	saveCheck(ctx context.Context, projectID string, check CheckResult) error
+	saveIncident(ctx context.Context, incident Incident) error
+	loadHistory(perProject int) (map[string][]CheckResult, error)
+	loadIncidents(limit int) ([]Incident, error)
+	deleteHistory(ctx context.Context, projectID string) error
+	// trimHistory keeps only the newest perProject checks of each project.
+	trimHistory(ctx context.Context, perProject int) error
 }
 
-func (s *Store) markConfirmed(email string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.confirmedEmails[strings.ToLower(strings.TrimSpace(email))] = time.Now().UnixMilli()
-	s.persistConfirmedToDiskLocked()
+// sqlBackend stores rows as JSON documents keyed by project and timestamp, so
+// new CheckResult/Incident fields don't need a schema change. The same
+// queries serve SQLite and Postgres; only the table names differ.
+type sqlBackend struct {
+	db             *sql.DB
+	checksTable    string
+	incidentsTable string
 }
 
-func (s *Store) allowAction(key string, window time.Duration, limit int) bool {
-	now := time.Now().UnixMilli()
-	cutoff := now - window.Milliseconds()
-
-	s.mu.Lock()
-	defer s.mu.Unlock()
+var sqliteMigrations = []string{
+	`CREATE TABLE checks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		project_id TEXT NOT NULL,
+		ts INTEGER NOT NULL,
+		data TEXT NOT NULL
+	)`,
+	`CREATE INDEX checks_project_id ON checks (project_id, id)`,
+	`CREATE TABLE incidents (
+		id TEXT PRIMARY KEY,
+		project_id TEXT NOT NULL,
+		ts INTEGER NOT NULL,
+		data TEXT NOT NULL
+	)`,
+}
 
-	items := s.rateBuckets[key]
-	filtered := items[:0]
-	for _, ts := range items {
-		if ts >= cutoff {
-			filtered = append(filtered, ts)
-		}
+func openSQLiteBackend(path string) (*sqlBackend, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
 	}
-	if len(filtered) >= limit {
-		s.rateBuckets[key] = filtered
-		return false
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(`PRAGMA journal_mode=WAL`); err != nil {
+		db.Close()
+		return nil, err
 	}
-	filtered = append(filtered, now)
-	s.rateBuckets[key] = filtered
-	return true
-}
-
-type ConfirmTokenPayload struct {
-	Email    string `json:"email"`
-	Username string `json:"username"`
-	Exp      int64  `json:"exp"`
-	Nonce    string `json:"nonce"`
+	if err := migrate(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlBackend{db: db, checksTable: "checks", incidentsTable: "incidents"}, nil
 }
 
-func randomNonce() (string, error) {
-	b := make([]byte, 12)
-	if _, err := rand.Read(b); err != nil {
-		return "", err
-	}
-	return base64.RawURLEncoding.EncodeToString(b), nil
+var postgresMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS heartbeat_checks (
+		id BIGSERIAL PRIMARY KEY,
+		project_id TEXT NOT NULL,
+		ts BIGINT NOT NULL,
+		data JSONB NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS heartbeat_checks_project_id ON heartbeat_checks (project_id, id)`,
+	`CREATE TABLE IF NOT EXISTS heartbeat_incidents (
+		id TEXT PRIMARY KEY,
+		project_id TEXT NOT NULL,
+		ts BIGINT NOT NULL,
+		data JSONB NOT NULL
+	)`,
 }
 
-func signConfirmToken(secret string, payload ConfirmTokenPayload) (string, error) {
-	raw, err := json.Marshal(payload)
+// openPostgresBackend connects through pgx's database/sql driver, whose
+// pool is bounded by maxOpen/maxIdle so replicas share the server fairly.
+func openPostgresBackend(dsn string, maxOpen, maxIdle int) (*sqlBackend, error) {
+	db, err := sql.Open("pgx", dsn)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	msg := base64.RawURLEncoding.EncodeToString(raw)
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write([]byte(msg))
-	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
-	return msg + "." + sig, nil
-}
-
-func verifyConfirmToken(secret string, token string) (ConfirmTokenPayload, bool) {
-	parts := strings.Split(token, ".")
-	if len(parts) != 2 {
-		return ConfirmTokenPayload{}, false
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxIdleTime(5 * time.Minute)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
 	}
-	msg := parts[0]
-	sig := parts[1]
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write([]byte(msg))
-	want := mac.Sum(nil)
-	got, err := base64.RawURLEncoding.DecodeString(sig)
-	if err != nil || !hmac.Equal(want, got) {
-		return ConfirmTokenPayload{}, false
+	if err := migrate(db, postgresMigrations); err != nil {
+		db.Close()
+		return nil, err
 	}
-	raw, err := base64.RawURLEncoding.DecodeString(msg)
-	if err != nil {
-		return ConfirmTokenPayload{}, false
+	return &sqlBackend{db: db, checksTable: "heartbeat_checks", incidentsTable: "heartbeat_incidents"}, nil
+}
+
+// migrate applies, in order, every migration newer than the version recorded
+// in schema_migrations. Each migration runs in its own transaction.
+func migrate(db *sql.DB, migrations []string) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
 	}
-	var p ConfirmTokenPayload
-	if err := json.Unmarshal(raw, &p); err != nil {
-		return ConfirmTokenPayload{}, false
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
 	}
-	if p.Exp <= 0 || time.Now().Unix() > p.Exp {
-		return ConfirmTokenPayload{}, false
+	for i := current; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// Replicas starting together may race; the loser's insert is a no-op.
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1) ON CONFLICT DO NOTHING`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
 	}
-	if strings.TrimSpace(p.Email) == "" {
-		return ConfirmTokenPayload{}, false
+	return nil
+}
+
+func (b *sqlBackend) saveCheck(ctx context.Context, projectID string, check CheckResult) error {
+	data, err := json.Marshal(check)
+	if err != nil {
+		return err
 	}
-	return p, true
+	_, err = b.db.ExecContext(ctx, `INSERT INTO `+b.checksTable+` (project_id, ts, data) VALUES ($1, $2, $3)`, projectID, check.TS, string(data))
+	return err
 }
 
-func doWebhook(cfg Config, incident Incident) {
-	payload := map[string]any{
-		"id":          incident.ID,
-		"ts":          incident.TS,
-		"projectId":   incident.ProjectID,
-		"projectName": incident.ProjectName,
-		"status":      incident.Status,
-		"message":     incident.Message,
+// trimHistory keeps the table bounded like the in-memory history.
+func (b *sqlBackend) trimHistory(ctx context.Context, perProject int) error {
+	_, err := b.db.ExecContext(ctx, `DELETE FROM `+b.checksTable+` WHERE id IN (
+		SELECT id FROM (
+			SELECT id, ROW_NUMBER() OVER (PARTITION BY project_id ORDER BY id DESC) AS rn
+			FROM `+b.checksTable+`
+		) ranked WHERE rn > $1
+	)`, perProject)
+	return err
+}
+
+func (b *sqlBackend) deleteHistory(ctx context.Context, projectID string) error {
+	_, err := b.db.ExecContext(ctx, `DELETE FROM `+b.checksTable+` WHERE project_id = $1`, projectID)
+	return err
+}
+
+func (b *sqlBackend) saveIncident(ctx context.Context, incident Incident) error {
+	data, err := json.Marshal(incident)
+	if err != nil {
+		return err
 	}
-	body, _ := json.Marshal(payload)
+	_, err = b.db.ExecContext(ctx, `INSERT INTO `+b.incidentsTable+` (id, project_id, ts, data) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data`,
+		incident.ID, incident.ProjectID, incident.TS, string(data))
+	return err
+}
 
-	post := func(url string, raw []byte) {
-		if strings.TrimSpace(url) == "" {
-			return
+func (b *sqlBackend) loadHistory(perProject int) (map[string][]CheckResult, error) {
+	rows, err := b.db.Query(`SELECT project_id, data FROM (
+		SELECT project_id, data, id, ROW_NUMBER() OVER (PARTITION BY project_id ORDER BY id DESC) AS rn
+		FROM `+b.checksTable+`
+	) recent WHERE rn <= $1 ORDER BY id`, perProject)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string][]CheckResult)
+	for rows.Next() {
+		var projectID, data string
+		if err := rows.Scan(&projectID, &data); err != nil {
+			return nil, err
 		}
-		req, err := http.NewRequest("POST", url, strings.NewReader(string(raw)))
-		if err != nil {
-			return
+		var check CheckResult
+		if err := json.Unmarshal([]byte(data), &check); err != nil {
+			return nil, err
 		}
-		req.Header.Set("Content-Type", "application/json")
-		client := &http.Client{Timeout: 5 * time.Second}
-		_, _ = client.Do(req)
+		out[projectID] = append(out[projectID], check)
 	}
+	return out, rows.Err()
+}
+
+func (b *sqlBackend) loadIncidents(limit int) ([]Incident, error) {
+	rows, err := b.db.Query(`SELECT data FROM `+b.incidentsTable+` ORDER BY ts DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Incident
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var incident Incident
+		if err := json.Unmarshal([]byte(data), &incident); err != nil {
+			return nil, err
+		}
+		out = append(out, incident)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) addCheck(project Project, check CheckResult) *Incident {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	check.Anomaly = s.latencyAnomalyLocked(project.ID, check)
+	existing := s.historyByID[project.ID]
+	if len(existing) == 0 || existing[len(existing)-1].Status != check.Status {
+		s.recordStatusChangeLocked(project.ID, check)
+	}
+	if isUpStatus(check.Status) {
+		s.lastHealthyTS[project.ID] = check.TS
+	}
+	existing = append(existing, check)
+	// The count cap always bounds memory; the age limit may trim further.
+	if len(existing) > maxHistoryPerProject {
+		existing = existing[len(existing)-maxHistoryPerProject:]
+	}
+	if s.historyRetention > 0 {
+		cutoff := time.Now().Add(-s.historyRetention).UnixMilli()
+		keep := sort.Search(len(existing), func(i int) bool { return existing[i].TS >= cutoff })
+		existing = existing[keep:]
+	}
+	s.historyByID[project.ID] = existing
+	s.projectNameByID[project.ID] = project.Name
+	s.projectTagsByID[project.ID] = append([]string(nil), project.Tags...)
+	s.persistCheckLocked(project.ID, check)
+	s.checkStream.publish(project.ID, check)
+
+	incident := s.transitionLocked(project, check)
+	if check.Anomaly {
+		s.consecutiveAnomalyCount[project.ID]++
+	} else {
+		s.consecutiveAnomalyCount[project.ID] = 0
+	}
+	// A sustained anomaly is reported once per streak, unless the same check
+	// already changed the project's status.
+	if incident == nil && s.anomalyAlertAfter > 0 && s.consecutiveAnomalyCount[project.ID] == s.anomalyAlertAfter {
+		now := time.Now().UnixMilli()
+		s.log.Warn("sustained latency anomaly", "project_id", project.ID, "latency_ms", check.LatencyMs,
+			"checks", s.anomalyAlertAfter)
+		// Notification only: it isn't kept with the status incidents, so it
+		// doesn't skew MTTR.
+		return &Incident{
+			ID:          fmt.Sprintf("%d_%s_ANOMALY", now, project.ID),
+			TS:          now,
+			ProjectID:   project.ID,
+			ProjectName: project.Name,
+			Status:      "ANOMALY",
+			Severity:    incidentSeverity("ANOMALY"),
+			Message:     fmt.Sprintf("Latency anomaly: %d ms, well above the recent baseline", check.LatencyMs),
+			OpenedAt:    now,
+			ResolvedAt:  now,
+		}
+	}
+	return incident
+}
+
+// minAnomalyBaseline is the fewest successful checks needed before latency
+// anomalies are flagged.
+const minAnomalyBaseline = 5
+
+// latencyAnomalyLocked reports whether check's latency exceeds mean + k·stddev
+// of the project's last anomalyWindow successful latencies. DOWN checks and
+// earlier anomalies never count towards the baseline, so a sustained spike
+// keeps being flagged. The stddev is floored at 5% of the mean so a
+// perfectly flat baseline doesn't flag every millisecond of noise.
+func (s *Store) latencyAnomalyLocked(projectID string, check CheckResult) bool {
+	if s.anomalyK <= 0 || !isUpStatus(check.Status) || check.LatencyMs <= 0 {
+		return false
+	}
+	var lat []float64
+	h := s.historyByID[projectID]
+	for i := len(h) - 1; i >= 0 && len(lat) < s.anomalyWindow; i-- {
+		if isUpStatus(h[i].Status) && h[i].LatencyMs > 0 && !h[i].Anomaly {
+			lat = append(lat, float64(h[i].LatencyMs))
+		}
+	}
+	if len(lat) < minAnomalyBaseline {
+		return false
+	}
+	var sum float64
+	for _, v := range lat {
+		sum += v
+	}
+	mean := sum / float64(len(lat))
+	var variance float64
+	for _, v := range lat {
+		variance += (v - mean) * (v - mean)
+	}
+	stddev := max(math.Sqrt(variance/float64(len(lat))), mean*0.05, 1)
+	return float64(check.LatencyMs) > mean+s.anomalyK*stddev
+}
+
+// transitionLocked applies the debounced status change for check and returns
+// the incident to notify about, if any.
+func (s *Store) transitionLocked(project Project, check CheckResult) *Incident {
+	// History keeps every raw check, but the recorded status only moves to DOWN
+	// (or back out of it) after enough consecutive checks agree.
+	if check.Status == "DOWN" {
+		s.consecutiveFailCount[project.ID]++
+		s.consecutiveOKCount[project.ID] = 0
+		threshold := project.ConsecutiveFailThreshold
+		if threshold < 1 {
+			threshold = s.failureThreshold
+		}
+		if s.consecutiveFailCount[project.ID] < max(threshold, 1) {
+			return nil
+		}
+	} else {
+		s.consecutiveFailCount[project.ID] = 0
+		s.consecutiveOKCount[project.ID]++
+		if s.lastStatusByID[project.ID] == "DOWN" && s.consecutiveOKCount[project.ID] < s.recoveryThreshold {
+			return nil
+		}
+	}
+
+	prevStatus, ok := s.lastStatusByID[project.ID]
+	s.lastStatusByID[project.ID] = check.Status
+	if !ok || prevStatus == check.Status {
+		return nil
+	}
+
+	now := time.Now().UnixMilli()
+	open := s.openIncidentLocked(project.ID)
+	if open != nil {
+		open.ResolvedAt = now
+		s.persistIncidentLocked(*open)
+		s.log.Info("incident resolved", "incident_id", open.ID, "project_id", project.ID,
+			"status", check.Status, "duration_ms", open.DurationMs())
+	}
+	if check.Status == "HEALTHY" {
+		// Recovery closes the open incident rather than recording a new one; the
+		// returned copy only carries the recovery status for notifications.
+		recovered := Incident{
+			ID:          fmt.Sprintf("%d_%s_%s", now, project.ID, check.Status),
+			TS:          now,
+			ProjectID:   project.ID,
+			ProjectName: project.Name,
+			OpenedAt:    now,
+			ResolvedAt:  now,
+		}
+		if open != nil {
+			recovered = *open
+		}
+		recovered.Status = check.Status
+		recovered.Severity = incidentSeverity(check.Status)
+		recovered.Message = statusMessage(check.Status)
+		return &recovered
+	}
+
+	incident := Incident{
+		ID:          fmt.Sprintf("%d_%s_%s", now, project.ID, check.Status),
+		TS:          now,
+		ProjectID:   project.ID,
+		ProjectName: project.Name,
+		Status:      check.Status,
+		Severity:    incidentSeverity(check.Status),
+		Message:     statusMessage(check.Status),
+		OpenedAt:    now,
+	}
+	if check.ErrorCategory == "DNS_FAILURE" {
+		incident.Message = "Service went DOWN: DNS name did not resolve"
+	}
+	s.incidents = append([]Incident{incident}, s.incidents...)
+	if len(s.incidents) > maxIncidents {
+		s.incidents = s.incidents[:maxIncidents]
+	}
+	s.persistIncidentLocked(incident)
+	s.log.Info("incident opened", "incident_id", incident.ID, "project_id", project.ID,
+		"project", project.Name, "status", incident.Status, "previous_status", prevStatus)
+	return &incident
+}
+
+var (
+	errIncidentNotFound = errors.New("incident not found")
+	errIncidentResolved = errors.New("incident already resolved")
+)
+
+// incidentByID returns a stored incident by ID.
+func (s *Store) incidentByID(id string) (Incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, inc := range s.incidents {
+		if inc.ID == id {
+			return inc, nil
+		}
+	}
+	return Incident{}, errIncidentNotFound
+}
+
+// acknowledgeIncident marks an open incident as acknowledged by the given
+// (optional) name.
+func (s *Store) acknowledgeIncident(id, by string) (Incident, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.incidents {
+		inc := &s.incidents[i]
+		if inc.ID != id {
+			continue
+		}
+		if inc.ResolvedAt != 0 {
+			return *inc, errIncidentResolved
+		}
+		inc.Acknowledged = true
+		inc.AckedBy = by
+		inc.AckedAt = time.Now().UnixMilli()
+		s.persistIncidentLocked(*inc)
+		return *inc, nil
+	}
+	return Incident{}, errIncidentNotFound
+}
+
+// notificationsSilenced reports whether the project's open incident has been
+// acknowledged. The next status change resolves it and lifts the silence.
+func (s *Store) notificationsSilenced(projectID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	open := s.openIncidentLocked(projectID)
+	return open != nil && open.Acknowledged
+}
+
+// openIncidentLocked returns the most recent unresolved incident for the
+// project, or nil. Callers must hold s.mu.
+func (s *Store) openIncidentLocked(projectID string) *Incident {
+	for i := range s.incidents {
+		if s.incidents[i].ProjectID == projectID && s.incidents[i].ResolvedAt == 0 {
+			return &s.incidents[i]
+		}
+	}
+	return nil
+}
+
+// allowProbe is the per-target circuit breaker. Once a project has failed
+// after consecutive checks in a row, it only allows a probe when the backoff
+// from the previous one has passed: interval doubled per failure beyond
+// after, capped at maxBackoff. Any non-DOWN check resets the failure count
+// and so closes the breaker.
+func (s *Store) allowProbe(p Project, interval time.Duration, after int, maxBackoff time.Duration, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failures := s.consecutiveFailCount[p.ID]
+	if after <= 0 || failures < after {
+		delete(s.nextProbeAt, p.ID)
+		return true
+	}
+	if now.Before(s.nextProbeAt[p.ID]) {
+		return false
+	}
+	backoff := interval << min(failures-after+1, 20)
+	if backoff > maxBackoff || backoff <= 0 {
+		backoff = max(maxBackoff, interval)
+	}
+	s.nextProbeAt[p.ID] = now.Add(backoff)
+	return true
+}
+
+// dueReminders returns an escalation for every project whose DOWN incident
+// has gone interval without an alert or reminder, and records it as sent.
+// Reminders pause while heartbeat itself looks isolated; recovered projects
+// drop out because their incident is resolved.
+func (s *Store) dueReminders(interval time.Duration, now time.Time) []Incident {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nowMs := now.UnixMilli()
+	var out []Incident
+	down := make(map[string]bool)
+	for _, inc := range s.incidents {
+		if inc.ResolvedAt != 0 || inc.Status != "DOWN" || down[inc.ProjectID] {
+			continue
+		}
+		down[inc.ProjectID] = true
+		last := max(inc.OpenedAt, s.lastReminder[inc.ProjectID])
+		if s.isolatedSince != 0 || nowMs-last < interval.Milliseconds() {
+			continue
+		}
+		s.lastReminder[inc.ProjectID] = nowMs
+		outage := time.Duration(nowMs-inc.OpenedAt) * time.Millisecond
+		reminder := inc
+		reminder.ID = fmt.Sprintf("%s_reminder_%d", inc.ID, nowMs)
+		reminder.TS = nowMs
+		reminder.Message = fmt.Sprintf("Reminder: service still DOWN after %s", outage.Truncate(time.Minute))
+		out = append(out, reminder)
+	}
+	for projectID := range s.lastReminder {
+		if !down[projectID] {
+			delete(s.lastReminder, projectID)
+		}
+	}
+	return out
+}
+
+func statusMessage(status string) string {
+	switch status {
+	case "DOWN":
+		return "Service went DOWN"
+	case "HEALTHY":
+		return "Service recovered"
+	case "DEGRADED":
+		return "Service is DEGRADED"
+	case "SLOW":
+		return "Service is SLOW"
+	case "REDIRECT":
+		return "Service is REDIRECTING"
+	default:
+		return "Status changed"
+	}
+}
+
+// StoreStats is a snapshot of the Store's in-memory contents for debugging.
+type StoreStats struct {
+	HistoryProjects []string       `json:"historyProjects"`
+	ChecksByProject map[string]int `json:"checksByProject"`
+	Incidents       int            `json:"incidents"`
+	ConfirmedEmails int            `json:"confirmedEmails"`
+	RateBuckets     map[string]int `json:"rateBuckets"`
+	TokenBuckets    int            `json:"tokenBuckets"`
+	Scheduled       int            `json:"scheduled"`
+}
+
+func (s *Store) debugStats() StoreStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := StoreStats{
+		HistoryProjects: make([]string, 0, len(s.historyByID)),
+		ChecksByProject: make(map[string]int, len(s.historyByID)),
+		Incidents:       len(s.incidents),
+		ConfirmedEmails: len(s.confirmedEmails),
+		RateBuckets:     make(map[string]int, len(s.rateBuckets)),
+		TokenBuckets:    len(s.tokenBuckets),
+		Scheduled:       s.scheduler.size(),
+	}
+	for id, h := range s.historyByID {
+		st.HistoryProjects = append(st.HistoryProjects, id)
+		st.ChecksByProject[id] = len(h)
+	}
+	sort.Strings(st.HistoryProjects)
+	for k, items := range s.rateBuckets {
+		st.RateBuckets[k] = len(items)
+	}
+	return st
+}
+
+// minIsolationProjects is the fewest checked projects that can indicate
+// heartbeat itself lost connectivity rather than a single service failing.
+const minIsolationProjects = 2
+
+// trackIsolation records whether the share of enabled projects whose latest
+// status is DOWN means heartbeat is cut off. It looks at every project in the
+// last fetched list rather than one ping batch, since the scheduler checks
+// projects a few at a time. It returns the self-check incident to notify when
+// that state starts or ends, and whether heartbeat is currently isolated.
+func (s *Store) trackIsolation(threshold float64) (*Incident, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	down, total := 0, 0
+	for _, p := range s.projects.projects {
+		status, checked := s.lastStatusByID[p.ID]
+		if !p.isEnabled() || !checked {
+			continue
+		}
+		total++
+		if status == "DOWN" {
+			down++
+		}
+	}
+	if threshold <= 0 || total < minIsolationProjects {
+		return nil, s.isolatedSince != 0
+	}
+	now := time.Now().UnixMilli()
+	isolated := float64(down)/float64(total) >= threshold
+	switch {
+	case isolated && s.isolatedSince == 0:
+		s.isolatedSince = now
+		s.log.Error("heartbeat may be isolated", "down", down, "total", total)
+		return &Incident{
+			ID:          fmt.Sprintf("%d_heartbeat_ISOLATED", now),
+			TS:          now,
+			ProjectID:   "heartbeat",
+			ProjectName: "Heartbeat",
+			Status:      "ISOLATED",
+			Severity:    incidentSeverity("ISOLATED"),
+			Message:     fmt.Sprintf("Heartbeat may have lost connectivity: %d/%d services unreachable", down, total),
+			OpenedAt:    now,
+		}, true
+	case !isolated && s.isolatedSince != 0:
+		openedAt := s.isolatedSince
+		s.isolatedSince = 0
+		s.log.Info("heartbeat connectivity restored", "down", down, "total", total)
+		return &Incident{
+			ID:          fmt.Sprintf("%d_heartbeat_ISOLATED", openedAt),
+			TS:          now,
+			ProjectID:   "heartbeat",
+			ProjectName: "Heartbeat",
+			Status:      "HEALTHY",
+			Severity:    incidentSeverity("HEALTHY"),
+			Message:     fmt.Sprintf("Heartbeat connectivity restored: %d/%d services unreachable", down, total),
+			OpenedAt:    openedAt,
+			ResolvedAt:  now,
+		}, false
+	}
+	return nil, isolated
+}
+
+// Reset forgets a project's check history and status tracking, e.g. after its
+// URL changed. Any open incident is resolved since its baseline is gone. It
+// returns how many checks were dropped and the last known status.
+func (s *Store) Reset(projectID string) (int, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := len(s.historyByID[projectID])
+	prevStatus := s.lastStatusByID[projectID]
+	delete(s.historyByID, projectID)
+	delete(s.lastStatusByID, projectID)
+	delete(s.statusChanges, projectID)
+	delete(s.lastHealthyTS, projectID)
+	delete(s.consecutiveFailCount, projectID)
+	delete(s.consecutiveOKCount, projectID)
+	delete(s.consecutiveAnomalyCount, projectID)
+	delete(s.nextProbeAt, projectID)
+	if open := s.openIncidentLocked(projectID); open != nil {
+		open.ResolvedAt = time.Now().UnixMilli()
+		s.persistIncidentLocked(*open)
+	}
+	s.queueBackendWriteLocked("delete history", func(ctx context.Context) {
+		if err := s.backend.deleteHistory(ctx, projectID); err != nil {
+			s.log.Error("store: delete history failed", "project_id", projectID, "error", err)
+		}
+	})
+	s.summaryCache = nil
+	s.log.Info("history reset", "project_id", projectID, "deleted", deleted, "previous_status", prevStatus)
+	return deleted, prevStatus
+}
+
+// invalidateStatus drops the cached ping cycle so the next /status call
+// refetches the project list. Fetches already in flight may predate the
+// change, so later callers don't join them and their results aren't cached.
+func (s *Store) invalidateStatus() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusGen++
+	s.statusSnapshot = nil
+	s.statusInFlight = nil
+	s.projects.projects = nil
+	s.projects.inFlight = nil
+}
+
+// cachedProjects returns the cached project list while it is younger than
+// the cache ttl, otherwise calls fetch once for all concurrent callers. Stale
+// lists from the circuit breaker are passed through but never cached.
+func (s *Store) cachedProjects(fetch func() ([]Project, bool, error)) ([]Project, bool, error) {
+	s.mu.Lock()
+	pc := &s.projects
+	if pc.ttl > 0 && pc.projects != nil && time.Since(pc.fetchedAt) < pc.ttl {
+		out := append([]Project(nil), pc.projects...)
+		s.mu.Unlock()
+		return out, false, nil
+	}
+	if call := pc.inFlight; call != nil {
+		s.mu.Unlock()
+		<-call.done
+		return append([]Project(nil), call.projects...), call.stale, call.err
+	}
+	call := &projectFetch{done: make(chan struct{})}
+	pc.inFlight = call
+	gen := s.statusGen
+	s.mu.Unlock()
+
+	call.projects, call.stale, call.err = fetch()
+
+	s.mu.Lock()
+	if pc.inFlight == call {
+		pc.inFlight = nil
+	}
+	if call.err == nil && !call.stale && gen == s.statusGen {
+		pc.projects = call.projects
+		pc.fetchedAt = time.Now()
+	}
+	s.mu.Unlock()
+	close(call.done)
+	return append([]Project(nil), call.projects...), call.stale, call.err
+}
+
+// cachedStatus serves the last ping cycle's results while younger than ttl,
+// along with how long that cycle spent fetching projects from Supabase.
+// Otherwise it runs refresh, with concurrent callers sharing one in-flight run.
+func (s *Store) cachedStatus(ttl time.Duration, refresh func() ([]Project, time.Duration, error)) ([]Project, time.Duration, error) {
+	s.mu.Lock()
+	if ttl > 0 && s.statusSnapshot != nil && time.Since(s.statusSnapshotAt) < ttl {
+		out := append([]Project(nil), s.statusSnapshot...)
+		fetchTime := s.statusFetchTime
+		s.mu.Unlock()
+		return out, fetchTime, nil
+	}
+	if call := s.statusInFlight; call != nil {
+		s.mu.Unlock()
+		<-call.done
+		return append([]Project(nil), call.projects...), call.fetchTime, call.err
+	}
+	call := &statusRefresh{done: make(chan struct{})}
+	s.statusInFlight = call
+	gen := s.statusGen
+	s.mu.Unlock()
+
+	call.projects, call.fetchTime, call.err = refresh()
+
+	s.mu.Lock()
+	if s.statusInFlight == call {
+		s.statusInFlight = nil
+	}
+	if call.err == nil && gen == s.statusGen {
+		s.statusSnapshot = call.projects
+		s.statusSnapshotAt = time.Now()
+		s.statusFetchTime = call.fetchTime
+	}
+	s.mu.Unlock()
+	close(call.done)
+	return append([]Project(nil), call.projects...), call.fetchTime, call.err
+}
+
+// statusRank orders statuses from best to worst for roll-ups.
+func statusRank(status string) int {
+	switch status {
+	case "HEALTHY":
+		return 1
+	case "SLOW":
+		return 2
+	case "REDIRECT":
+		return 3
+	case "DEGRADED":
+		return 4
+	case "DOWN":
+		return 5
+	default:
+		return 0
+	}
+}
+
+// uptimePercent is the share of checks since the given time that weren't DOWN.
+// ok is false when there were no checks to judge by.
+func uptimePercent(checks []CheckResult, since int64) (pct float64, ok bool) {
+	total, up := 0, 0
+	for _, c := range checks {
+		if c.TS < since {
+			continue
+		}
+		total++
+		if c.Status != "DOWN" {
+			up++
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return float64(up) * 100 / float64(total), true
+}
+
+// validSLATarget reports whether pct is a usable uptime target. 100% is
+// excluded since it leaves no error budget to measure against.
+func validSLATarget(pct float64) bool {
+	return pct > 0 && pct < 100
+}
+
+// SLAReport measures a project's uptime over a window against its target.
+// The budget fields are nil without a target or without checks covering the
+// whole window, and everything but the target is nil when there were no
+// checks in the window.
+type SLAReport struct {
+	ProjectID string  `json:"projectId"`
+	Window    string  `json:"window"`
+	Target    float64 `json:"target,omitempty"`
+	// Status is "met", "breached", "no target", "no data" or, when the
+	// oldest retained check is newer than the window's start,
+	// "insufficient data".
+	Status string `json:"status"`
+	// CoveredFrom (unix ms) and Covered are where and how long the retained
+	// checks actually reach back within the window; Uptime is over that span.
+	CoveredFrom int64    `json:"coveredFrom,omitempty"`
+	Covered     string   `json:"covered,omitempty"`
+	Uptime      *float64 `json:"uptime"`
+	// ErrorBudgetConsumed is the share (%) of allowed downtime used; it can
+	// exceed 100 once the SLA is breached.
+	ErrorBudgetConsumed      *float64 `json:"errorBudgetConsumed"`
+	AllowedDowntimeMinutes   *float64 `json:"allowedDowntimeMinutes"`
+	RemainingDowntimeMinutes *float64 `json:"remainingDowntimeMinutes"`
+}
+
+// sla computes the SLA report for one project over the window ending now.
+// Downtime is the window's length scaled by the share of DOWN checks, so it
+// is only estimated when retained history covers the whole window.
+func (s *Store) sla(projectID string, window time.Duration, target float64) SLAReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := SLAReport{ProjectID: projectID, Window: window.String(), Target: target, Status: "no data"}
+	now := time.Now()
+	windowStart := now.Add(-window).UnixMilli()
+	checks := s.historyByID[projectID]
+	pct, ok := uptimePercent(checks, windowStart)
+	if !ok {
+		return out
+	}
+	out.Uptime = &pct
+	out.CoveredFrom = max(checks[0].TS, windowStart)
+	out.Covered = now.Sub(time.UnixMilli(out.CoveredFrom)).Round(time.Second).String()
+	if checks[0].TS > windowStart {
+		out.Status = "insufficient data"
+		return out
+	}
+	if target == 0 {
+		out.Status = "no target"
+		return out
+	}
+	windowMinutes := window.Minutes()
+	allowed := (100 - target) / 100 * windowMinutes
+	down := (100 - pct) / 100 * windowMinutes
+	consumed := down / allowed * 100
+	remaining := max(allowed-down, 0)
+	out.AllowedDowntimeMinutes = &allowed
+	out.RemainingDowntimeMinutes = &remaining
+	out.ErrorBudgetConsumed = &consumed
+	out.Status = "met"
+	if pct < target {
+		out.Status = "breached"
+	}
+	return out
+}
+
+// TimelineDay is one calendar day of a project's uptime timeline. Rating is
+// "ok" (uptime >= 99.9%), "partial", "outage" (below 95%), "no data", or
+// "insufficient data" for days before the oldest retained check.
+type TimelineDay struct {
+	Date      string   `json:"date"`
+	Checks    int      `json:"checks"`
+	Uptime    *float64 `json:"uptime"`
+	Incidents int      `json:"incidents"`
+	Rating    string   `json:"rating"`
+	// Partial marks the day retained history starts in, whose uptime only
+	// reflects the part of the day after the oldest check.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// timeline buckets a project's checks and opened incidents into the last
+// days calendar days in loc, oldest first and ending today. Days without
+// checks are kept as "no data" so the result has no gaps, except days that
+// history no longer reaches back to, which are "insufficient data".
+func (s *Store) timeline(projectID string, days int, loc *time.Location, now time.Time) []TimelineDay {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now = now.In(loc)
+	first := time.Date(now.Year(), now.Month(), now.Day()-days+1, 0, 0, 0, 0, loc)
+	out := make([]TimelineDay, days)
+	index := make(map[string]int, days)
+	for i := range out {
+		date := first.AddDate(0, 0, i).Format(time.DateOnly)
+		out[i] = TimelineDay{Date: date, Rating: "no data"}
+		index[date] = i
+	}
+	checks := s.historyByID[projectID]
+	if len(checks) > 0 {
+		oldest := checks[0].TS
+		for i := range out {
+			dayStart, nextDay := first.AddDate(0, 0, i).UnixMilli(), first.AddDate(0, 0, i+1).UnixMilli()
+			switch {
+			case oldest >= nextDay:
+				out[i].Rating = "insufficient data"
+			case oldest > dayStart:
+				out[i].Partial = true
+			}
+		}
+	}
+	up := make([]int, days)
+	for _, c := range checks {
+		if i, ok := index[time.UnixMilli(c.TS).In(loc).Format(time.DateOnly)]; ok {
+			out[i].Checks++
+			if c.Status != "DOWN" {
+				up[i]++
+			}
+		}
+	}
+	for _, inc := range s.incidents {
+		if inc.ProjectID != projectID {
+			continue
+		}
+		if i, ok := index[time.UnixMilli(inc.OpenedAt).In(loc).Format(time.DateOnly)]; ok {
+			out[i].Incidents++
+		}
+	}
+	for i := range out {
+		if out[i].Checks == 0 {
+			continue
+		}
+		pct := float64(up[i]) * 100 / float64(out[i].Checks)
+		out[i].Uptime = &pct
+		switch {
+		case pct >= 99.9:
+			out[i].Rating = "ok"
+		case pct >= 95:
+			out[i].Rating = "partial"
+		default:
+			out[i].Rating = "outage"
+		}
+	}
+	return out
+}
+
+type Summary struct {
+	Status        string         `json:"status"`
+	Counts        map[string]int `json:"counts"`
+	OpenIncidents int            `json:"openIncidents"`
+	Uptime24h     *float64       `json:"uptime24h"`
+	GeneratedAt   int64          `json:"generatedAt"`
+
+	// Window bounds Uptime and Incidents, which count incidents opened in it.
+	Window          string     `json:"window"`
+	Uptime          *float64   `json:"uptime"`
+	Incidents       int        `json:"incidents"`
+	RecentIncidents []Incident `json:"recentIncidents,omitempty"`
+}
+
+// summary rolls up the latest known statuses, the last 24h of history and
+// the given window, plus the recent newest incidents, all under one lock.
+// A non-empty tag scopes everything to the projects carrying it. The result
+// is reused for maxAge so busy status pages don't recompute it.
+func (s *Store) summary(maxAge, window time.Duration, recent int, tag string) Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := fmt.Sprintf("%s|%d|%s", window, recent, tag)
+	if s.summaryCache != nil && s.summaryCacheKey == key && time.Since(s.summaryCacheAt) < maxAge {
+		return *s.summaryCache
+	}
+
+	now := time.Now()
+	sum := Summary{
+		Status:      "UNKNOWN",
+		Counts:      map[string]int{"HEALTHY": 0, "SLOW": 0, "REDIRECT": 0, "DEGRADED": 0, "DOWN": 0},
+		GeneratedAt: now.UnixMilli(),
+		Window:      window.String(),
+	}
+	inScope := func(projectID string) bool {
+		return tag == "" || slices.Contains(s.projectTagsByID[projectID], tag)
+	}
+	for id, status := range s.lastStatusByID {
+		if !inScope(id) {
+			continue
+		}
+		sum.Counts[status]++
+		if statusRank(status) > statusRank(sum.Status) {
+			sum.Status = status
+		}
+	}
+	windowStart := now.Add(-window).UnixMilli()
+	for _, inc := range s.incidents {
+		if !inScope(inc.ProjectID) {
+			continue
+		}
+		if inc.ResolvedAt == 0 {
+			sum.OpenIncidents++
+		}
+		if inc.OpenedAt >= windowStart {
+			sum.Incidents++
+		}
+		if len(sum.RecentIncidents) < recent {
+			sum.RecentIncidents = append(sum.RecentIncidents, inc)
+		}
+	}
+	since := now.Add(-24 * time.Hour).UnixMilli()
+	var all []CheckResult
+	for id, h := range s.historyByID {
+		if inScope(id) {
+			all = append(all, h...)
+		}
+	}
+	if pct, ok := uptimePercent(all, since); ok {
+		sum.Uptime24h = &pct
+	}
+	if pct, ok := uptimePercent(all, windowStart); ok {
+		sum.Uptime = &pct
+	}
+
+	s.summaryCache = &sum
+	s.summaryCacheAt = now
+	s.summaryCacheKey = key
+	return sum
+}
+
+// GroupSummary rolls up the latest statuses of the projects sharing a tag.
+type GroupSummary struct {
+	Tag    string         `json:"tag"`
+	Status string         `json:"status"`
+	Counts map[string]int `json:"counts"`
+}
+
+// groups aggregates lastStatusByID per tag, sorted by tag. Projects without
+// tags are reported under "untagged".
+func (s *Store) groups() []GroupSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	byTag := make(map[string]*GroupSummary)
+	for id, status := range s.lastStatusByID {
+		tags := s.projectTagsByID[id]
+		if len(tags) == 0 {
+			tags = []string{"untagged"}
+		}
+		for _, tag := range tags {
+			g, ok := byTag[tag]
+			if !ok {
+				g = &GroupSummary{
+					Tag:    tag,
+					Status: "UNKNOWN",
+					Counts: map[string]int{"HEALTHY": 0, "SLOW": 0, "REDIRECT": 0, "DEGRADED": 0, "DOWN": 0},
+				}
+				byTag[tag] = g
+			}
+			g.Counts[status]++
+			if statusRank(status) > statusRank(g.Status) {
+				g.Status = status
+			}
+		}
+	}
+	out := make([]GroupSummary, 0, len(byTag))
+	for _, g := range byTag {
+		out = append(out, *g)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Tag < out[j].Tag })
+	return out
+}
+
+// latestStatus returns the recorded status and name of a project, if any.
+func (s *Store) latestStatus(projectID string) (status, name string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok = s.lastStatusByID[projectID]
+	return status, s.projectNameByID[projectID], ok
+}
+
+// fillLatest sets each project's status and latency from its most recent
+// check. Projects the scheduler hasn't reached yet report PENDING.
+func (s *Store) fillLatest(projects []Project) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range projects {
+		p := &projects[i]
+		p.Latency = 0
+		h := s.historyByID[p.ID]
+		switch {
+		case !p.isEnabled():
+			p.Status = "DISABLED"
+		case len(h) == 0:
+			p.Status = "PENDING"
+		default:
+			p.Status = h[len(h)-1].Status
+			p.Latency = h[len(h)-1].LatencyMs
+		}
+	}
+}
+
+// fillLastHealthy sets LastHealthyAt on each project from the recorded checks.
+func (s *Store) fillLastHealthy(projects []Project) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range projects {
+		projects[i].LastHealthyAt = nil
+		if ts, ok := s.lastHealthyTS[projects[i].ID]; ok {
+			projects[i].LastHealthyAt = &ts
+		}
+	}
+}
+
+// StatusChange is a project whose check status changed since a diff's
+// since_ts. PreviousStatus is empty when the status at since_ts is unknown.
+type StatusChange struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Status         string `json:"status"`
+	PreviousStatus string `json:"previousStatus,omitempty"`
+	Latency        int64  `json:"latency"`
+	TS             int64  `json:"ts"`
+	ChangedAt      int64  `json:"changedAt"`
+}
+
+// statusChange is one change of a project's raw check status. A check's TS
+// is taken before it is recorded, so seq, which orders the change against
+// diff cursors, is raised past the last cursor handed out: a check that was
+// in flight while a diff was served still counts as newer than its cursor.
+type statusChange struct {
+	seq    int64
+	ts     int64
+	status string
+}
+
+// recordStatusChangeLocked appends check's status to the project's change
+// log. Callers must hold s.mu.
+func (s *Store) recordStatusChangeLocked(projectID string, check CheckResult) {
+	seq := max(check.TS, s.diffCursor+1)
+	s.lastChangeSeq = max(s.lastChangeSeq, seq)
+	changes := append(s.statusChanges[projectID], statusChange{
+		seq:    seq,
+		ts:     check.TS,
+		status: check.Status,
+	})
+	if len(changes) > maxHistoryPerProject {
+		changes = changes[len(changes)-maxHistoryPerProject:]
+	}
+	s.statusChanges[projectID] = changes
+}
+
+// statusDiff lists projects whose latest check status differs from their
+// status as of since (unix ms), from recorded checks only. It also returns
+// the cursor to pass as the next since.
+func (s *Store) statusDiff(since int64) ([]StatusChange, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The cursor covers every change recorded so far, including ones whose
+	// seq was raised past the clock.
+	cursor := max(time.Now().UnixMilli(), s.diffCursor, s.lastChangeSeq)
+	s.diffCursor = cursor
+	out := []StatusChange{}
+	for id, changes := range s.statusChanges {
+		last := changes[len(changes)-1]
+		if last.seq <= since {
+			continue
+		}
+		h := s.historyByID[id]
+		if len(h) == 0 {
+			continue
+		}
+		latest := h[len(h)-1]
+		change := StatusChange{
+			ID:        id,
+			Name:      s.projectNameByID[id],
+			Status:    latest.Status,
+			Latency:   latest.LatencyMs,
+			TS:        latest.TS,
+			ChangedAt: last.ts,
+		}
+		// The status at since is the last one recorded at or before it; a
+		// project that flapped back to it since hasn't changed.
+		if i := sort.Search(len(changes), func(i int) bool { return changes[i].seq > since }); i > 0 {
+			change.PreviousStatus = changes[i-1].status
+			if change.PreviousStatus == latest.Status {
+				continue
+			}
+		}
+		out = append(out, change)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, cursor
+}
+
+// maxBulkHistoryProjects caps project_ids on /api/v1/history/bulk.
+const maxBulkHistoryProjects = 100
+
+// historyResolutions are the bucket sizes accepted by ?resolution=.
+var historyResolutions = map[string]time.Duration{
+	"raw": 0,
+	"1m":  time.Minute,
+	"5m":  5 * time.Minute,
+	"1h":  time.Hour,
+	"1d":  24 * time.Hour,
+}
+
+// getHistory returns the last limit checks for a project. A non-zero
+// resolution downsamples first, so limit counts buckets instead.
+func (s *Store) getHistory(projectID string, limit int, resolution time.Duration) []CheckResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := s.historyByID[projectID]
+	if resolution > 0 {
+		h = downsample(h, resolution)
+	}
+	if limit <= 0 || limit > len(h) {
+		limit = len(h)
+	}
+	out := make([]CheckResult, limit)
+	copy(out, h[len(h)-limit:])
+	return out
+}
+
+// downsample folds time-ordered results into buckets of width res aligned
+// to the Unix epoch. Each bucket is stamped with its start and carries the
+// worst status seen (with that check's code and error), the sample count,
+// and the mean latency of its successful checks.
+func downsample(results []CheckResult, res time.Duration) []CheckResult {
+	width := res.Milliseconds()
+	var out []CheckResult
+	var latSum, latN int64
+	flush := func() {
+		if latN > 0 {
+			out[len(out)-1].LatencyMs = latSum / latN
+		}
+		latSum, latN = 0, 0
+	}
+	for _, r := range results {
+		start := r.TS - ((r.TS%width)+width)%width
+		if len(out) == 0 || out[len(out)-1].TS != start {
+			if len(out) > 0 {
+				flush()
+			}
+			out = append(out, CheckResult{TS: start, Status: r.Status, Code: r.Code, Error: r.Error, ErrorCategory: r.ErrorCategory})
+		}
+		b := &out[len(out)-1]
+		b.Samples++
+		if statusRank(r.Status) > statusRank(b.Status) {
+			b.Status, b.Code, b.Error, b.ErrorCategory = r.Status, r.Code, r.Error, r.ErrorCategory
+		}
+		if isUpStatus(r.Status) && r.LatencyMs > 0 {
+			latSum += r.LatencyMs
+			latN++
+		}
+	}
+	if len(out) > 0 {
+		flush()
+	}
+	return out
+}
+
+// latencyPercentiles computes nearest-rank latency percentiles over the
+// successful (HEALTHY/SLOW/DEGRADED, non-zero latency) checks in results.
+func (s *Store) latencyPercentiles(results []CheckResult) map[string]int64 {
+	var lat []int64
+	for _, r := range results {
+		if isUpStatus(r.Status) && r.LatencyMs > 0 {
+			lat = append(lat, r.LatencyMs)
+		}
+	}
+	out := make(map[string]int64)
+	if len(lat) == 0 {
+		return out
+	}
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	for _, p := range []int{50, 75, 90, 95, 99} {
+		rank := (p*len(lat) + 99) / 100 // ceil(p/100 * n)
+		out["p"+strconv.Itoa(p)] = lat[max(rank, 1)-1]
+	}
+	return out
+}
+
+// getIncidents returns up to limit of the newest incidents, optionally only
+// those with the given status and/or severity.
+func (s *Store) getIncidents(limit int, status, severity string) []Incident {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit <= 0 || limit > len(s.incidents) {
+		limit = len(s.incidents)
+	}
+	out := make([]Incident, 0, limit)
+	for _, inc := range s.incidents {
+		if len(out) == limit {
+			break
+		}
+		if (status != "" && inc.Status != status) || (severity != "" && inc.Severity != severity) {
+			continue
+		}
+		out = append(out, inc)
+	}
+	return out
+}
+
+// MTTR summarizes recovery times of incidents resolved within a window.
+type MTTR struct {
+	MeanMs   int64 `json:"meanMs"`
+	MedianMs int64 `json:"medianMs"`
+	Resolved int   `json:"resolved"`
+	Ongoing  int   `json:"ongoing"`
+}
+
+// mttr averages the durations of incidents resolved since the given unix
+// millisecond time, optionally limited to one project. Open incidents are
+// only counted as ongoing.
+func (s *Store) mttr(projectID string, since int64) MTTR {
+	s.mu.Lock()
+	var durations []int64
+	var out MTTR
+	for _, inc := range s.incidents {
+		if projectID != "" && inc.ProjectID != projectID {
+			continue
+		}
+		if inc.ResolvedAt == 0 {
+			out.Ongoing++
+			continue
+		}
+		if inc.ResolvedAt >= since {
+			durations = append(durations, inc.DurationMs())
+		}
+	}
+	s.mu.Unlock()
+
+	out.Resolved = len(durations)
+	if len(durations) == 0 {
+		return out
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	var total int64
+	for _, d := range durations {
+		total += d
+	}
+	out.MeanMs = total / int64(len(durations))
+	mid := len(durations) / 2
+	if len(durations)%2 == 0 {
+		out.MedianMs = (durations[mid-1] + durations[mid]) / 2
+	} else {
+		out.MedianMs = durations[mid]
+	}
+	return out
+}
+
+// IncidentStats summarizes how often a project has incidents and how long
+// they last. The means are omitted when there isn't enough data for them.
+type IncidentStats struct {
+	ProjectID                  string `json:"projectId,omitempty"`
+	TotalIncidents             int    `json:"totalIncidents"`
+	DownIncidents              int    `json:"downIncidents"`
+	DegradedIncidents          int    `json:"degradedIncidents"`
+	MeanTimeBetweenIncidentsMs *int64 `json:"meanTimeBetweenIncidentsMs,omitempty"`
+	MeanTimeToRecoveryMs       *int64 `json:"meanTimeToRecoveryMs,omitempty"`
+}
+
+// incidentStats computes IncidentStats over the retained incidents of one
+// project, or of all projects when projectID is empty. The time between
+// incidents is measured from one opening to the next, so it needs at least
+// two; recovery time only counts resolved incidents.
+func (s *Store) incidentStats(projectID string) IncidentStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := IncidentStats{ProjectID: projectID}
+	var opened []int64
+	var recoveryTotal int64
+	resolved := 0
+	for _, inc := range s.incidents {
+		if projectID != "" && inc.ProjectID != projectID {
+			continue
+		}
+		out.TotalIncidents++
+		switch inc.Status {
+		case "DOWN":
+			out.DownIncidents++
+		case "DEGRADED":
+			out.DegradedIncidents++
+		}
+		opened = append(opened, inc.OpenedAt)
+		if inc.ResolvedAt != 0 {
+			recoveryTotal += inc.DurationMs()
+			resolved++
+		}
+	}
+	if len(opened) >= 2 {
+		sort.Slice(opened, func(i, j int) bool { return opened[i] < opened[j] })
+		mtbi := (opened[len(opened)-1] - opened[0]) / int64(len(opened)-1)
+		out.MeanTimeBetweenIncidentsMs = &mtbi
+	}
+	if resolved > 0 {
+		mttr := recoveryTotal / int64(resolved)
+		out.MeanTimeToRecoveryMs = &mttr
+	}
+	return out
+}
+
+// parseWindow parses a look-back window such as "30d", "12h" or "90m".
+func parseWindow(raw string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(raw, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid window %q", raw)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid window %q", raw)
+	}
+	return d, nil
+}
+
+// confirmLogEntry is one line of the confirmation write-ahead log.
+type confirmLogEntry struct {
+	Op    string `json:"op"` // "confirm", "remove" or "nonce"
+	Email string `json:"email,omitempty"`
+	TS    int64  `json:"ts,omitempty"`
+	// Nonce and Exp record the single-use token that made a confirmation, or
+	// on their own, one consumed by unsubscribe or revoke.
+	Nonce string `json:"nonce,omitempty"`
+	Exp   int64  `json:"exp,omitempty"`
+}
+
+// confirmNoncesPath is where consumed confirmation nonces are snapshotted,
+// next to the confirmed-email snapshot.
+func (s *Store) confirmNoncesPath() string {
+	return s.confirmStorePath + ".nonces"
+}
+
+// loadConfirmedFromDisk rebuilds the confirmed set from the last snapshot plus
+// every entry appended to the WAL since, then compacts the two.
+func (s *Store) loadConfirmedFromDisk() {
+	if s.confirmStorePath == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, err := os.ReadFile(s.confirmStorePath); err == nil {
+		var m map[string]int64
+		if err := json.Unmarshal(b, &m); err == nil {
+			for k, v := range m {
+				s.confirmedEmails[strings.ToLower(strings.TrimSpace(k))] = v
+			}
+		}
+	}
+	now := time.Now().Unix()
+	if b, err := os.ReadFile(s.confirmNoncesPath()); err == nil {
+		var m map[string]int64
+		if err := json.Unmarshal(b, &m); err == nil {
+			for nonce, exp := range m {
+				if exp >= now {
+					s.usedNonces[nonce] = exp
+				}
+			}
+		}
+	}
+	if s.confirmWALPath == "" {
+		return
+	}
+	b, err := os.ReadFile(s.confirmWALPath)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		var e confirmLogEntry
+		// A torn final line from a crash mid-append is simply skipped.
+		if json.Unmarshal([]byte(line), &e) != nil {
+			continue
+		}
+		if e.Nonce != "" && e.Exp >= now {
+			s.usedNonces[e.Nonce] = e.Exp
+		}
+		if e.Email == "" {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(e.Email))
+		switch e.Op {
+		case "confirm":
+			s.confirmedEmails[key] = e.TS
+		case "remove":
+			delete(s.confirmedEmails, key)
+		}
+	}
+	s.compactConfirmedLocked()
+}
+
+// appendConfirmLogLocked records a single change in the WAL. Without a WAL it
+// falls back to rewriting the full snapshot.
+func (s *Store) appendConfirmLogLocked(e confirmLogEntry) {
+	if s.confirmWALPath == "" {
+		s.persistConfirmedToDiskLocked()
+		return
+	}
+	line, _ := json.Marshal(e)
+	f, err := os.OpenFile(s.confirmWALPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, _ = f.Write(append(line, '\n'))
+}
+
+// compactConfirmedLocked writes a fresh snapshot and only then truncates the
+// WAL, so a crash in between just replays entries already in the snapshot.
+func (s *Store) compactConfirmedLocked() {
+	s.persistConfirmedToDiskLocked()
+	if s.confirmWALPath != "" {
+		_ = os.Truncate(s.confirmWALPath, 0)
+	}
+}
+
+func (s *Store) compactConfirmedLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		s.compactConfirmedLocked()
+		s.mu.Unlock()
+	}
+}
+
+func (s *Store) persistConfirmedToDiskLocked() {
+	if s.confirmStorePath == "" {
+		return
+	}
+	tmp := s.confirmStorePath + ".tmp"
+	b, _ := json.MarshalIndent(s.confirmedEmails, "", "  ")
+	_ = os.WriteFile(tmp, b, 0o600)
+	_ = os.Rename(tmp, s.confirmStorePath)
+
+	noncesTmp := s.confirmNoncesPath() + ".tmp"
+	b, _ = json.Marshal(s.usedNonces)
+	_ = os.WriteFile(noncesTmp, b, 0o600)
+	_ = os.Rename(noncesTmp, s.confirmNoncesPath())
+}
+
+func (s *Store) isConfirmed(email string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts, ok := s.confirmedEmails[strings.ToLower(strings.TrimSpace(email))]
+	return ok && !s.confirmExpiredLocked(ts, time.Now().UnixMilli())
+}
+
+func (s *Store) confirmExpiredLocked(confirmedAt int64, now int64) bool {
+	return s.confirmRetention > 0 && now-confirmedAt > s.confirmRetention.Milliseconds()
+}
+
+// pruneConfirmed drops confirmations older than the retention period.
+func (s *Store) pruneConfirmed() int {
+	s.mu.Lock()
+	retention := s.confirmRetention
+	s.mu.Unlock()
+	if retention <= 0 {
+		return 0
+	}
+	return s.expireConfirmedEmails(time.Now().UnixMilli() - retention.Milliseconds())
+}
+
+// expireConfirmedEmails removes confirmations made before the given unix
+// millisecond time, re-persists the store when anything was removed, and
+// returns how many entries were dropped.
+func (s *Store) expireConfirmedEmails(before int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for email, ts := range s.confirmedEmails {
+		if ts < before {
+			delete(s.confirmedEmails, email)
+			removed++
+		}
+	}
+	if removed > 0 {
+		s.compactConfirmedLocked()
+	}
+	return removed
+}
+
+func (s *Store) sweepConfirmedLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.pruneConfirmed()
+	}
+}
+
+// confirmWithNonce marks email confirmed and consumes the token nonce under
+// one lock, so two concurrent presentations of a link can't both succeed. It
+// returns false, changing nothing, if the nonce was already used.
+func (s *Store) confirmWithNonce(email, nonce string, expiry int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, used := s.usedNonces[nonce]; used {
+		return false
+	}
+	s.usedNonces[nonce] = expiry
+	key := strings.ToLower(strings.TrimSpace(email))
+	now := time.Now().UnixMilli()
+	s.confirmedEmails[key] = now
+	s.appendConfirmLogLocked(confirmLogEntry{Op: "confirm", Email: key, TS: now, Nonce: nonce, Exp: expiry})
+	return true
+}
+
+// confirmedRecipients lists every confirmation that hasn't expired.
+func (s *Store) confirmedRecipients() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UnixMilli()
+	out := make([]string, 0, len(s.confirmedEmails))
+	for email, ts := range s.confirmedEmails {
+		if !s.confirmExpiredLocked(ts, now) {
+			out = append(out, email)
+		}
+	}
+	return out
+}
+
+// ConfirmedStats counts unexpired subscriptions, in total and by how
+// recently they were confirmed.
+type ConfirmedStats struct {
+	Total          int            `json:"total"`
+	ConfirmedSince map[string]int `json:"confirmedSince"`
+}
+
+// confirmedStats computes every bucket in one pass over the confirmations.
+func (s *Store) confirmedStats() ConfirmedStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UnixMilli()
+	const day = int64(24 * time.Hour / time.Millisecond)
+	stats := ConfirmedStats{ConfirmedSince: map[string]int{"1d": 0, "7d": 0, "30d": 0}}
+	for _, ts := range s.confirmedEmails {
+		if s.confirmExpiredLocked(ts, now) {
+			continue
+		}
+		stats.Total++
+		age := now - ts
+		if age <= day {
+			stats.ConfirmedSince["1d"]++
+		}
+		if age <= 7*day {
+			stats.ConfirmedSince["7d"]++
+		}
+		if age <= 30*day {
+			stats.ConfirmedSince["30d"]++
+		}
+	}
+	return stats
+}
+
+// removeConfirmed deletes a confirmation and reports whether one existed.
+func (s *Store) removeConfirmed(email string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(strings.TrimSpace(email))
+	if _, ok := s.confirmedEmails[key]; !ok {
+		return false
+	}
+	delete(s.confirmedEmails, key)
+	s.appendConfirmLogLocked(confirmLogEntry{Op: "remove", Email: key})
+	return true
+}
+
+// consumeNonce records a token nonce as used until expiry (unix seconds),
+// logging it so it stays used across restarts. It returns false if the nonce
+// was already used.
+func (s *Store) consumeNonce(nonce string, expiry int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, used := s.usedNonces[nonce]; used {
+		return false
+	}
+	s.usedNonces[nonce] = expiry
+	s.appendConfirmLogLocked(confirmLogEntry{Op: "nonce", Nonce: nonce, Exp: expiry})
+	return true
+}
+
+// pruneNonces forgets nonces whose tokens have expired; verifyConfirmToken
+// rejects those tokens anyway.
+func (s *Store) pruneNonces() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().Unix()
+	removed := 0
+	for nonce, exp := range s.usedNonces {
+		if exp < now {
+			delete(s.usedNonces, nonce)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (s *Store) pruneNoncesLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.pruneNonces()
+	}
+}
+
+// RateLimitInfo describes a bucket after an allowAction call. Reset is the
+// unix time (seconds) at which the oldest counted request leaves the window.
+type RateLimitInfo struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     int64
+}
+
+// allowAction admits at most limit actions per window for key, using the
+// sliding window or, with RATE_LIMIT_ALGO=token_bucket, a token bucket.
+func (s *Store) allowAction(key string, window time.Duration, limit int) RateLimitInfo {
+	s.mu.Lock()
+	if s.rateAlgo == "token_bucket" {
+		b, ok := s.tokenBuckets[key]
+		if !ok {
+			b = &TokenBucket{current: float64(limit), lastRefill: time.Now()}
+			s.tokenBuckets[key] = b
+		}
+		s.mu.Unlock()
+		return b.take(limit, window)
+	}
+	defer s.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	cutoff := now - window.Milliseconds()
+
+	if window > s.rateMaxWindow {
+		s.rateMaxWindow = window
+	}
+	items := s.rateBuckets[key]
+	filtered := items[:0]
+	for _, ts := range items {
+		if ts >= cutoff {
+			filtered = append(filtered, ts)
+		}
+	}
+	info := RateLimitInfo{Limit: limit}
+	if len(filtered) < limit {
+		filtered = append(filtered, now)
+		info.Allowed = true
+	}
+	s.rateBuckets[key] = filtered
+	info.Remaining = max(limit-len(filtered), 0)
+	oldest := now
+	if len(filtered) > 0 {
+		oldest = filtered[0]
+	}
+	info.Reset = (oldest + window.Milliseconds() + 999) / 1000
+	return info
+}
+
+// TokenBucket holds up to capacity tokens, refilled continuously at
+// tokensPerSecond; each allowed action takes one. Unlike the sliding window
+// it keeps constant state per key however busy the key is.
+type TokenBucket struct {
+	mu              sync.Mutex
+	capacity        int
+	tokensPerSecond float64
+	current         float64
+	lastRefill      time.Time
+}
+
+// take refills the bucket for limit tokens per window and tries to take one.
+// Reset is when the bucket will be full again, or when the next token
+// arrives if the action was rejected.
+func (b *TokenBucket) take(limit int, window time.Duration) RateLimitInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Limits can change on config reload, so they are applied on every call.
+	b.capacity = limit
+	b.tokensPerSecond = float64(limit) / window.Seconds()
+	b.refillLocked(time.Now())
+
+	info := RateLimitInfo{Limit: limit}
+	if b.current >= 1 {
+		b.current--
+		info.Allowed = true
+	}
+	info.Remaining = int(b.current)
+	wait := float64(b.capacity) - b.current
+	if !info.Allowed {
+		wait = 1 - b.current
+	}
+	reset := b.lastRefill.Add(time.Duration(wait / b.tokensPerSecond * float64(time.Second)))
+	info.Reset = (reset.UnixMilli() + 999) / 1000
+	return info
+}
+
+func (b *TokenBucket) refillLocked(now time.Time) {
+	b.current = min(float64(b.capacity), b.current+now.Sub(b.lastRefill).Seconds()*b.tokensPerSecond)
+	b.lastRefill = now
+}
+
+// full reports whether the bucket has refilled completely, at which point
+// dropping it is the same as keeping it.
+func (b *TokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(now)
+	return b.current >= float64(b.capacity)
+}
+
+// setRateLimitHeaders reports the tightest of the given buckets, adding
+// Retry-After when the request was rejected.
+func setRateLimitHeaders(c *gin.Context, infos ...RateLimitInfo) {
+	tightest := infos[0]
+	for _, info := range infos[1:] {
+		if !info.Allowed || (tightest.Allowed && info.Remaining < tightest.Remaining) {
+			tightest = info
+		}
+	}
+	c.Header("X-RateLimit-Limit", strconv.Itoa(tightest.Limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(tightest.Reset, 10))
+	if !tightest.Allowed {
+		c.Header("Retry-After", strconv.FormatInt(max(tightest.Reset-time.Now().Unix(), 1), 10))
+	}
+}
+
+// sweepRateBuckets removes buckets whose newest entry is older than the
+// largest window seen by allowAction, so they can no longer limit anything.
+// Keys are processed in small batches to keep each lock hold short.
+func (s *Store) sweepRateBuckets() int {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.rateBuckets))
+	for k := range s.rateBuckets {
+		keys = append(keys, k)
+	}
+	s.mu.Unlock()
+
+	const batch = 256
+	removed := s.sweepTokenBuckets()
+	for i := 0; i < len(keys); i += batch {
+		end := min(i+batch, len(keys))
+		s.mu.Lock()
+		cutoff := time.Now().UnixMilli() - s.rateMaxWindow.Milliseconds()
+		for _, k := range keys[i:end] {
+			items, ok := s.rateBuckets[k]
+			if !ok {
+				continue
+			}
+			if len(items) == 0 || items[len(items)-1] < cutoff {
+				delete(s.rateBuckets, k)
+				removed++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return removed
+}
+
+// sweepTokenBuckets removes token buckets that have refilled completely.
+func (s *Store) sweepTokenBuckets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	removed := 0
+	for k, b := range s.tokenBuckets {
+		if b.full(now) {
+			delete(s.tokenBuckets, k)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (s *Store) sweepRateBucketsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.sweepRateBuckets()
+	}
+}
+
+type ConfirmTokenPayload struct {
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	Exp      int64  `json:"exp"`
+	Nonce    string `json:"nonce"`
+	// Action is empty for confirmation tokens and "unsubscribe" for
+	// unsubscribe links, so one kind can never be redeemed as the other.
+	Action string `json:"action,omitempty"`
+}
+
+// normalizeEmail validates a bare address (no display name) with a dotted
+// domain and returns it trimmed, with the domain lowercased and a trailing
+// root dot dropped.
+func normalizeEmail(raw string) (string, error) {
+	raw = strings.TrimSuffix(strings.TrimSpace(raw), ".")
+	addr, err := mail.ParseAddress(raw)
+	if err != nil || addr.Address != raw {
+		return "", errors.New("invalid email address")
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	local, domain := addr.Address[:at], strings.ToLower(addr.Address[at+1:])
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", errors.New("invalid email address")
+		}
+	}
+	if !strings.Contains(domain, ".") {
+		return "", errors.New("invalid email address")
+	}
+	return local + "@" + domain, nil
+}
+
+func randomNonce() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func signConfirmToken(secret string, payload ConfirmTokenPayload) (string, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	msg := base64.RawURLEncoding.EncodeToString(raw)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	return msg + "." + sig, nil
+}
+
+// confirmSecrets lists the secrets confirm tokens may be signed with: the
+// primary first, then the retired ones still accepted during a rotation.
+func (cfg Config) confirmSecrets() []string {
+	return append([]string{cfg.ConfirmTokenSecret}, cfg.ConfirmTokenSecretsOld...)
+}
+
+// verifyConfirmToken checks token against each secret in order and accepts
+// the first that produced its signature.
+func verifyConfirmToken(secrets []string, token string) (ConfirmTokenPayload, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return ConfirmTokenPayload{}, false
+	}
+	msg := parts[0]
+	sig := parts[1]
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return ConfirmTokenPayload{}, false
+	}
+	signed := false
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(msg))
+		if hmac.Equal(mac.Sum(nil), got) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return ConfirmTokenPayload{}, false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(msg)
+	if err != nil {
+		return ConfirmTokenPayload{}, false
+	}
+	var p ConfirmTokenPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return ConfirmTokenPayload{}, false
+	}
+	if p.Exp <= 0 || time.Now().Unix() > p.Exp {
+		return ConfirmTokenPayload{}, false
+	}
+	if strings.TrimSpace(p.Email) == "" {
+		return ConfirmTokenPayload{}, false
+	}
+	return p, true
+}
+
+// notifyIncident fans an incident out to every configured channel.
+func notifyIncident(cfg Config, logger *slog.Logger, store *Store, incident Incident) {
+	// A status change resolves the acknowledged incident before it's notified,
+	// so only repeats (reminders, anomaly alerts) can hit the silence;
+	// recoveries always go out.
+	if incident.Status != "HEALTHY" && store.notificationsSilenced(incident.ProjectID) {
+		logger.Info("notification silenced by acknowledgment", "incident_id", incident.ID, "project_id", incident.ProjectID)
+		return
+	}
+	if severityRank(incident.Severity) < severityRank(cfg.MinNotifySeverity) {
+		logger.Debug("notification below MIN_NOTIFY_SEVERITY", "incident_id", incident.ID, "severity", incident.Severity)
+		return
+	}
+	doWebhook(cfg, logger, incident)
+	if cfg.SMTPHost != "" {
+		sendIncidentEmails(cfg, logger, store, incident)
+	}
+}
+
+// sendIncidentEmails mails confirmed subscribers. Repeats of the same status
+// for a project are suppressed for cfg.EmailSuppressWindow.
+func sendIncidentEmails(cfg Config, logger *slog.Logger, store *Store, incident Incident) {
+	if cfg.EmailSuppressWindow > 0 &&
+		!store.allowAction("smtp:"+incident.ProjectID+":"+incident.Status, cfg.EmailSuppressWindow, 1).Allowed {
+		return
+	}
+	subject := fmt.Sprintf("[Heartbeat] %s: %s", incident.ProjectName, incident.Message)
+	body := fmt.Sprintf("%s\n\nProject: %s\nStatus: %s\nTime: %s\n",
+		incident.Message, incident.ProjectName, incident.Status,
+		displayTime(incident.TS, cfg.DisplayTimezone))
+	for _, to := range store.confirmedRecipients() {
+		if err := sendEmailNotification(cfg, to, subject, body); err != nil {
+			logger.Warn("incident email failed", "incident_id", incident.ID, "error", err)
+		}
+	}
+}
+
+// sendEmailNotification sends one plain-text message per recipient so
+// subscribers never see each other's addresses.
+func sendEmailNotification(cfg Config, to, subject, body string) error {
+	// Strip CR/LF so header values can't inject extra headers.
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	msg := "From: " + clean.Replace(cfg.SMTPFrom) + "\r\n" +
+		"To: " + clean.Replace(to) + "\r\n" +
+		"Subject: " + clean.Replace(subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	var auth smtp.Auth
+	if cfg.SMTPUser != "" {
+		auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return smtp.SendMail(net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort), auth, cfg.SMTPFrom, []string{to}, []byte(msg))
+}
+
+// displayTime formats a unix millisecond time for alert text, e.g.
+// "2024-06-01 14:32:05 EDT".
+func displayTime(ms int64, loc *time.Location) string {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return time.UnixMilli(ms).In(loc).Format("2006-01-02 15:04:05 MST")
+}
+
+// webhookPayload is the generic webhook body, and the data WEBHOOK_TEMPLATE
+// is rendered against. time is ts formatted in DISPLAY_TIMEZONE.
+func webhookPayload(incident Incident, loc *time.Location) map[string]any {
+	return map[string]any{
+		"id":          incident.ID,
+		"ts":          incident.TS,
+		"time":        displayTime(incident.TS, loc),
+		"projectId":   incident.ProjectID,
+		"projectName": incident.ProjectName,
+		"status":      incident.Status,
+		"severity":    incident.Severity,
+		"message":     incident.Message,
+	}
+}
+
+// cloudEvent wraps an incident in a structured-mode CloudEvents 1.0 envelope
+// with the generic webhook payload as data.
+func cloudEvent(incident Incident, loc *time.Location) map[string]any {
+	return map[string]any{
+		"specversion":     "1.0",
+		"type":            "com.heartbeat.incident",
+		"source":          "heartbeat",
+		"subject":         incident.ProjectID,
+		"id":              incident.ID,
+		"time":            time.UnixMilli(incident.TS).UTC().Format(time.RFC3339Nano),
+		"datacontenttype": "application/json",
+		"data":            webhookPayload(incident, loc),
+	}
+}
+
+// renderWebhookTemplate executes a text/template over payload. Referencing a
+// field that doesn't exist is an error.
+func renderWebhookTemplate(tmpl string, payload map[string]any) ([]byte, error) {
+	t, err := template.New("webhook").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// testIncident builds the synthetic incident sent by the notification test
+// endpoints.
+func testIncident(status string) Incident {
+	now := time.Now().UnixMilli()
+	return Incident{
+		ID:          fmt.Sprintf("%d_test", now),
+		TS:          now,
+		ProjectID:   "heartbeat-test",
+		ProjectName: "Heartbeat",
+		Status:      status,
+		Severity:    incidentSeverity(status),
+		Message:     "This is a heartbeat test alert",
+		OpenedAt:    now,
+		ResolvedAt:  now,
+	}
+}
+
+// DeliveryResult is the outcome of posting an incident to one channel.
+type DeliveryResult struct {
+	Channel    string `json:"channel"`
+	OK         bool   `json:"ok"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// doWebhook posts the incident to every configured channel and reports the
+// outcome of each delivery attempt.
+func doWebhook(cfg Config, logger *slog.Logger, incident Incident) []DeliveryResult {
+	var results []DeliveryResult
+	payload := webhookPayload(incident, cfg.DisplayTimezone)
+	when := displayTime(incident.TS, cfg.DisplayTimezone)
+	body, _ := json.Marshal(payload)
+	if strings.TrimSpace(cfg.WebhookTemplate) != "" {
+		rendered, err := renderWebhookTemplate(cfg.WebhookTemplate, payload)
+		if err != nil {
+			logger.Error("webhook template failed; sending default payload", "incident_id", incident.ID, "error", err)
+		} else {
+			body = rendered
+		}
+	}
+
+	post := func(channel, target, contentType string, raw []byte) {
+		if strings.TrimSpace(target) == "" {
+			return
+		}
+		result := DeliveryResult{Channel: channel}
+		defer func() { results = append(results, result) }()
+		requestID, _ := randomNonce()
+		log := logger.With("channel", channel, "incident_id", incident.ID, "project_id", incident.ProjectID, "request_id", requestID)
+		req, err := http.NewRequest("POST", target, strings.NewReader(string(raw)))
+		if err != nil {
+			log.Error("webhook request invalid", "error", err)
+			result.Error = "invalid request"
+			return
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(requestIDHeader, requestID)
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			// url.Error embeds the full URL, which can carry a secret (e.g. the
+			// Telegram bot token), so only log the underlying cause.
+			var uerr *url.Error
+			if errors.As(err, &uerr) {
+				err = uerr.Err
+			}
+			log.Warn("webhook delivery failed", "error", err)
+			result.Error = err.Error()
+			return
+		}
+		resp.Body.Close()
+		result.StatusCode = resp.StatusCode
+		if resp.StatusCode >= 300 {
+			log.Warn("webhook delivery rejected", "status_code", resp.StatusCode)
+			result.Error = "rejected"
+			return
+		}
+		result.OK = true
+		log.Info("webhook delivered", "status_code", resp.StatusCode)
+	}
+
+	// Generic webhook (JSON unless WEBHOOK_TEMPLATE says otherwise)
+	contentType := cfg.WebhookContentType
+	if strings.TrimSpace(cfg.WebhookTemplate) == "" || contentType == "" {
+		contentType = "application/json"
+	}
+	genericBody := body
+	if cfg.WebhookFormat == "cloudevents" {
+		contentType = "application/cloudevents+json"
+		genericBody, _ = json.Marshal(cloudEvent(incident, cfg.DisplayTimezone))
+	}
+	generic, target := "generic", cfg.WebhookURL
+	if incident.Status == "HEALTHY" && cfg.RecoveryWebhookURL != "" {
+		generic, target = "recovery", cfg.RecoveryWebhookURL
+	} else if incident.Status != "HEALTHY" && cfg.AlertWebhookURL != "" {
+		generic, target = "alert", cfg.AlertWebhookURL
+	}
+	post(generic, target, contentType, genericBody)
+
+	// Slack expects { "text": "..." }
+	if cfg.SlackWebhookURL != "" {
+		slackBody, _ := json.Marshal(map[string]string{
+			"text": fmt.Sprintf("*Heartbeat* %s — %s (%s)", incident.ProjectName, incident.Message, when),
+		})
+		post("slack", cfg.SlackWebhookURL, "application/json", slackBody)
+	}
+
+	// Discord expects { "content": "..." }
+	if cfg.DiscordWebhookURL != "" {
+		discordBody, _ := json.Marshal(map[string]string{
+			"content": fmt.Sprintf("**Heartbeat** %s — %s (%s)", incident.ProjectName, incident.Message, when),
+		})
+		post("discord", cfg.DiscordWebhookURL, "application/json", discordBody)
+	}
+
+	// Teams incoming webhooks take a legacy MessageCard
+	if cfg.TeamsWebhookURL != "" {
+		teamsBody, _ := json.Marshal(teamsCard(incident, when))
+		post("teams", cfg.TeamsWebhookURL, "application/json", teamsBody)
+	}
+
+	// Telegram Bot API sendMessage
+	if cfg.TelegramBotToken != "" && cfg.TelegramChatID != "" {
+		telegramBody, _ := json.Marshal(map[string]string{
+			"chat_id":    cfg.TelegramChatID,
+			"text":       fmt.Sprintf("*Heartbeat* %s — %s (%s)", escapeTelegramMarkdown(incident.ProjectName), escapeTelegramMarkdown(incident.Message), when),
+			"parse_mode": "Markdown",
+		})
+		post("telegram", "https://api.telegram.org/bot"+cfg.TelegramBotToken+"/sendMessage", "application/json", telegramBody)
+	}
+	return results
+}
+
+// teamsCard builds a Microsoft Teams MessageCard for the incident, themed by
+// severity: red for critical, yellow for warnings and green for recoveries.
+func teamsCard(incident Incident, when string) map[string]any {
+	color := "FFC107"
+	switch incident.Severity {
+	case "critical":
+		color = "D32F2F"
+	case "info":
+		color = "2E7D32"
+	}
+	return map[string]any{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"themeColor": color,
+		"summary":    fmt.Sprintf("Heartbeat: %s — %s", incident.ProjectName, incident.Message),
+		"title":      fmt.Sprintf("Heartbeat: %s", incident.ProjectName),
+		"sections": []map[string]any{{
+			"text": incident.Message,
+			"facts": []map[string]string{
+				{"name": "Status", "value": incident.Status},
+				{"name": "Severity", "value": incident.Severity},
+				{"name": "Time", "value": when},
+			},
+		}},
+	}
+}
+
+// escapeTelegramMarkdown escapes the characters Telegram's legacy Markdown
+// mode treats as formatting.
+func escapeTelegramMarkdown(s string) string {
+	return strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[").Replace(s)
+}
+
+// redisStream XADDs check results to a Redis stream from a single writer
+// goroutine. publish never blocks the caller: entries are dropped when the
+// queue is full, e.g. while Redis is unreachable.
+type redisStream struct {
+	client *redis.Client
+	key    string
+	maxLen int64
+	log    *slog.Logger
+	queue  chan map[string]any
+}
+
+func newRedisStream(rawURL, key string, maxLen int64, logger *slog.Logger) (*redisStream, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	rs := &redisStream{
+		client: redis.NewClient(opts),
+		key:    key,
+		maxLen: maxLen,
+		log:    logger,
+		queue:  make(chan map[string]any, 1024),
+	}
+	go rs.run()
+	return rs, nil
+}
+
+// publish queues a check as a stream entry: project_id plus each CheckResult
+// field under its JSON name, with nested values JSON-encoded. A nil stream
+// does nothing.
+func (rs *redisStream) publish(projectID string, check CheckResult) {
+	if rs == nil {
+		return
+	}
+	raw, err := json.Marshal(check)
+	if err != nil {
+		return
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return
+	}
+	for k, v := range fields {
+		switch v.(type) {
+		case map[string]any, []any:
+			b, _ := json.Marshal(v)
+			fields[k] = string(b)
+		}
+	}
+	fields["project_id"] = projectID
+	select {
+	case rs.queue <- fields:
+	default:
+		rs.log.Warn("redis stream queue full; dropping check", "project_id", projectID)
+	}
+}
+
+func (rs *redisStream) run() {
+	for fields := range rs.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := rs.client.XAdd(ctx, &redis.XAddArgs{
+			Stream: rs.key,
+			MaxLen: rs.maxLen,
+			Approx: rs.maxLen > 0,
+			Values: fields,
+		}).Err()
+		cancel()
+		if err != nil {
+			rs.log.Warn("redis stream write failed", "stream", rs.key, "error", err)
+		}
+	}
+}
+
+// checkSupabaseReady performs a cheap authenticated read against Supabase so
+// readiness probes fail when the project list can't actually be fetched.
+func checkSupabaseReady(cfg Config) error {
+	client := &http.Client{Timeout: 3 * time.Second}
+	req, err := http.NewRequest("GET", cfg.SupabaseURL+"/rest/v1/projects?select=id&limit=1", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", cfg.SupabaseAnonKey)
+	req.Header.Set("Authorization", "Bearer "+cfg.SupabaseAnonKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("supabase unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("supabase returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// pingTimings collects the phase breakdown of one request from httptrace
+// hooks. The transport dials on its own goroutine, so access is guarded.
+type pingTimings struct {
+	mu                               sync.Mutex
+	start                            time.Time
+	dnsStart, connectStart, tlsStart time.Time
+	dnsMs, connectMs, tlsMs, ttfbMs  int64
+}
+
+func (t *pingTimings) trace() *httptrace.ClientTrace {
+	since := func(from time.Time) int64 { return time.Since(from).Milliseconds() }
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.dnsMs = since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			t.mu.Lock()
+			if err == nil {
+				t.connectMs = since(t.connectStart)
+			}
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			t.tlsMs = since(t.tlsStart)
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.ttfbMs = since(t.start)
+			t.mu.Unlock()
+		},
+	}
+}
+
+// applyTo copies the breakdown onto a check.
+func (t *pingTimings) applyTo(check *CheckResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	check.DNSMs = t.dnsMs
+	check.ConnectMs = t.connectMs
+	check.TLSMs = t.tlsMs
+	check.TTFBMs = t.ttfbMs
+}
+
+// userAgentTransport sets User-Agent on requests that don't already carry
+// one, so per-project headers can still override it.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// readBody consumes up to limit bytes of body (0 = no limit) and reports how
+// many were read and whether more remained. Reading the body fully lets the
+// connection return to the pool. When keep is non-nil the bytes read, at
+// most limit of them, are also written to it.
+func readBody(body io.Reader, limit int64, keep *bytes.Buffer) (n int64, truncated bool) {
+	var dst io.Writer = io.Discard
+	if keep != nil {
+		dst = keep
+	}
+	if limit <= 0 {
+		n, _ = io.Copy(dst, body)
+		return n, false
+	}
+	// One extra byte tells a body of exactly limit bytes from a longer one.
+	n, _ = io.Copy(dst, io.LimitReader(body, limit+1))
+	if n > limit {
+		if keep != nil {
+			keep.Truncate(int(limit))
+		}
+		return limit, true
+	}
+	return n, false
+}
+
+// errContentMismatch marks a check whose body failed the project's keyword
+// assertion.
+var errContentMismatch = errors.New("content mismatch")
+
+// checkKeyword applies the project's keyword assertion to a response body:
+// the keyword (a regular expression when KeywordRegex is set) must appear,
+// or must not when KeywordAbsent is set. Bodies longer than
+// PING_MAX_BODY_BYTES are only searched up to that limit.
+func (p *Project) checkKeyword(body []byte) error {
+	if p.Keyword == "" {
+		return nil
+	}
+	var found bool
+	if p.KeywordRegex {
+		re, err := regexp.Compile(p.Keyword)
+		if err != nil {
+			return fmt.Errorf("%w: invalid keyword regex: %v", errContentMismatch, err)
+		}
+		found = re.Match(body)
+	} else {
+		found = bytes.Contains(body, []byte(p.Keyword))
+	}
+	switch {
+	case p.KeywordAbsent && found:
+		return fmt.Errorf("%w: body contains %q", errContentMismatch, p.Keyword)
+	case !p.KeywordAbsent && !found:
+		return fmt.Errorf("%w: body does not contain %q", errContentMismatch, p.Keyword)
+	}
+	return nil
+}
+
+// maxRetryDelay caps exponential ping backoff.
+const maxRetryDelay = 10 * time.Second
+
+// retryDelay is the pause after the given zero-based failed attempt. In
+// exponential mode the delay doubles per attempt up to maxRetryDelay, plus up
+// to 20% jitter so projects failing together don't retry in lockstep.
+func retryDelay(cfg Config, attempt int) time.Duration {
+	if cfg.PingRetryBackoff != "exponential" {
+		return cfg.PingRetryDelay
+	}
+	d := cfg.PingRetryDelay << attempt
+	if d > maxRetryDelay || d <= 0 {
+		d = maxRetryDelay
+	}
+	return d + mathrand.N(d/5+1)
+}
+
+// normalizeProjectURL trims raw and defaults it to https:// when no scheme
+// is given. URLs that still cannot be pinged over HTTP are rejected with an
+// "invalid URL" error so misconfiguration is not mistaken for an outage.
+func normalizeProjectURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", errors.New("invalid URL: empty")
+	}
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return "", fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid URL: unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", errors.New("invalid URL: missing host")
+	}
+	return u.String(), nil
+}
+
+// newPingTransport returns the transport shared by all pings so connections
+// to the same host are pooled across checks. Timeouts are applied per request
+// through a context deadline, which also bounds dialing and TLS.
+func newPingTransport(forceHTTP2 bool, minTLS uint16) *http.Transport {
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{KeepAlive: 30 * time.Second}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if minTLS != 0 {
+		// Targets that can only negotiate older versions fail the handshake.
+		t.TLSClientConfig = &tls.Config{MinVersion: minTLS}
+	}
+	if forceHTTP2 {
+		// HTTP/2 only: negotiated over TLS for https, prior knowledge (h2c)
+		// for plain http. Servers that can't speak it fail the check.
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP2(true)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return t
+}
+
+// pingService checks one project, records the result and returns the
+// incident it caused, if any, for the caller to notify.
+func pingService(p *Project, cfg Config, transport http.RoundTripper, store *Store, logger *slog.Logger) *Incident {
+	// The client is a cheap per-call wrapper; pooling lives in transport.
+	client := http.Client{
+		Transport: &userAgentTransport{userAgent: cfg.PingUserAgent, base: transport},
+	}
+	timeout := cfg.PingTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	if !p.followsRedirects() {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	// One correlation ID covers every attempt of this check.
+	requestID, _ := randomNonce()
+	if u, err := url.Parse(strings.TrimSpace(p.URL)); err == nil && (u.Scheme == "grpc" || u.Scheme == "grpcs") {
+		return pingGRPC(p, u, cfg, timeout, requestID, store, logger)
+	} else if err == nil && u.Scheme == "icmp" {
+		return pingICMP(p, u.Hostname(), cfg, timeout, requestID, store, logger)
+	} else if err == nil && u.Scheme == "dns" {
+		return pingDNS(p, u, cfg, timeout, requestID, store, logger)
+	}
+	target, urlErr := normalizeProjectURL(p.URL)
+	lastErr := urlErr
+	var lastCode int
+	var lastLocation, contentType, tlsVersion string
+	var contentLength int64
+	var bodyBytes int64
+	var bodyTruncated bool
+	var body *bytes.Buffer
+	if p.Keyword != "" {
+		body = new(bytes.Buffer)
+	}
+	var latencyMs int64
+	var timings *pingTimings
+
+	// A malformed URL is a configuration problem, so it is never retried.
+	for attempt := 0; urlErr == nil && attempt < cfg.PingRetries; attempt++ {
+		req, err := p.newPingRequest(target)
+		if err != nil {
+			lastErr = err
+			break
+		}
+		p.Credentials.apply(req)
+		req.Header.Set(requestIDHeader, requestID)
+		timings = &pingTimings{start: time.Now()}
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		req = req.WithContext(httptrace.WithClientTrace(ctx, timings.trace()))
+		resp, err := client.Do(req)
+		latencyMs = time.Since(timings.start).Milliseconds()
+		if err == nil {
+			lastCode = resp.StatusCode
+			lastLocation = resp.Header.Get("Location")
+			if req.Method != http.MethodHead {
+				contentType = resp.Header.Get("Content-Type")
+				contentLength = max(resp.ContentLength, 0)
+			}
+			if resp.TLS != nil {
+				tlsVersion = tls.VersionName(resp.TLS.Version)
+			}
+			if body != nil {
+				body.Reset()
+			}
+			bodyBytes, bodyTruncated = readBody(resp.Body, cfg.PingMaxBodyBytes, body)
+			resp.Body.Close()
+		}
+		cancel()
+		if err == nil && resp.StatusCode < 400 {
+			lastErr = nil
+			break
+		}
+		lastErr = err
+		if attempt < cfg.PingRetries-1 && cfg.PingRetryDelay > 0 {
+			time.Sleep(retryDelay(cfg, attempt))
+		}
+	}
+
+	if lastErr == nil && urlErr == nil && lastCode < 400 && body != nil {
+		lastErr = p.checkKeyword(body.Bytes())
+	}
+
+	p.Latency = latencyMs
+	if lastErr != nil || lastCode >= 400 {
+		p.Status = "DOWN"
+		p.Latency = 0
+		check := CheckResult{
+			TS:            time.Now().UnixMilli(),
+			Status:        "DOWN",
+			LatencyMs:     0,
+			Code:          lastCode,
+			BodyBytes:     bodyBytes,
+			BodyTruncated: bodyTruncated,
+		}
+		if lastErr != nil {
+			check.Error = p.Credentials.redact(lastErr.Error())
+			check.ErrorCategory = errorCategory(lastErr)
+			if check.ErrorCategory == "TLS_VERSION" {
+				check.Error = "TLS version too low: " + check.Error
+			}
+		}
+		logger.Warn("ping failed", "project_id", p.ID, "project", p.Name, "code", lastCode, "error", check.Error, "category", check.ErrorCategory, "request_id", requestID)
+		return store.addCheck(*p, check)
+	}
+
+	p.Status = classifyLatency(p.Latency, p, cfg)
+	if lastCode >= 300 && lastCode < 400 {
+		// Only reachable when the project doesn't follow redirects.
+		p.Status = "REDIRECT"
+	}
+	check := CheckResult{
+		TS:            time.Now().UnixMilli(),
+		Status:        p.Status,
+		LatencyMs:     p.Latency,
+		Code:          lastCode,
+		BodyBytes:     bodyBytes,
+		BodyTruncated: bodyTruncated,
+	}
+	if p.Status == "REDIRECT" {
+		check.RedirectLocation = lastLocation
+	}
+	check.ContentType = contentType
+	check.ContentLength = contentLength
+	check.TLSVersion = tlsVersion
+	// Failed checks keep the breakdown zeroed like their latency.
+	timings.applyTo(&check)
+	logger.Debug("ping ok", "project_id", p.ID, "status", p.Status, "latency_ms", p.Latency, "request_id", requestID)
+	return store.addCheck(*p, check)
+}
+
+// errorCategory names the kind of a failed check's error, or "" when it has
+// no finer category than DOWN. The categories are:
+//   - DNS_FAILURE: the name didn't resolve
+//   - CONTENT_MISMATCH: the body failed the keyword check
+//   - TLS_VERSION: the server only offered a TLS version below MIN_TLS_VERSION
+//   - DNS_MISMATCH: a dns:// check's answer lacked the expected value; pingDNS
+//     sets this one itself, since its error isn't recognisable here
+func errorCategory(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "DNS_FAILURE"
+	}
+	if errors.Is(err, errContentMismatch) {
+		return "CONTENT_MISMATCH"
+	}
+	// crypto/tls reports a version below MinVersion only in its message.
+	if strings.Contains(err.Error(), "tls: server selected unsupported protocol version") ||
+		strings.Contains(err.Error(), "tls: protocol version not supported") {
+		return "TLS_VERSION"
+	}
+	return ""
+}
+
+// classifyLatency grades a successful check: DEGRADED from the degraded
+// threshold up, SLOW from the slow threshold up, otherwise HEALTHY. A latency
+// exactly at a threshold gets that threshold's status. Project thresholds
+// override the global ones when > 0, and a slow threshold of 0 (the default)
+// or one at or above the degraded threshold never yields SLOW.
+func classifyLatency(latencyMs int64, p *Project, cfg Config) string {
+	degradedMs := cfg.DegradedMs
+	if p.DegradedMs > 0 {
+		degradedMs = p.DegradedMs
+	}
+	slowMs := cfg.SlowMs
+	if p.SlowMs > 0 {
+		slowMs = p.SlowMs
+	}
+	switch {
+	case latencyMs >= degradedMs:
+		return "DEGRADED"
+	case slowMs > 0 && latencyMs >= slowMs:
+		return "SLOW"
+	default:
+		return "HEALTHY"
+	}
+}
+
+// isUpStatus reports whether a check with this status got a usable response,
+// so its latency counts towards latency statistics.
+func isUpStatus(status string) bool {
+	return status == "HEALTHY" || status == "SLOW" || status == "DEGRADED"
+}
+
+// pingGRPC probes a grpc:// (plaintext) or grpcs:// (TLS) URL with the
+// standard grpc.health.v1 Check RPC. The URL path, if any, names the service
+// to check; otherwise the server's overall health is asked for. SERVING is
+// healthy (or degraded when slow) and anything else is DOWN.
+func pingGRPC(p *Project, u *url.URL, cfg Config, timeout time.Duration, requestID string, store *Store, logger *slog.Logger) *Incident {
+	creds := insecure.NewCredentials()
+	if u.Scheme == "grpcs" {
+		creds = credentials.NewTLS(&tls.Config{ServerName: u.Hostname()})
+	}
+	service := strings.TrimPrefix(u.Path, "/")
+
+	var lastErr error
+	var latencyMs int64
+	for attempt := 0; attempt < cfg.PingRetries; attempt++ {
+		start := time.Now()
+		lastErr = probeGRPCHealth(u.Host, service, creds, timeout, requestID)
+		latencyMs = time.Since(start).Milliseconds()
+		if lastErr == nil {
+			break
+		}
+		if attempt < cfg.PingRetries-1 && cfg.PingRetryDelay > 0 {
+			time.Sleep(retryDelay(cfg, attempt))
+		}
+	}
+
+	check := CheckResult{TS: time.Now().UnixMilli()}
+	if lastErr != nil {
+		p.Status = "DOWN"
+		p.Latency = 0
+		check.Status = "DOWN"
+		check.Error = lastErr.Error()
+		logger.Warn("ping failed", "project_id", p.ID, "project", p.Name, "error", check.Error, "request_id", requestID)
+		return store.addCheck(*p, check)
+	}
+	p.Latency = latencyMs
+	p.Status = classifyLatency(latencyMs, p, cfg)
+	check.Status = p.Status
+	check.LatencyMs = latencyMs
+	logger.Debug("ping ok", "project_id", p.ID, "status", p.Status, "latency_ms", p.Latency, "request_id", requestID)
+	return store.addCheck(*p, check)
+}
+
+// dnsRecordTypes are the record types a dns:// check can query.
+var dnsRecordTypes = []string{"A", "AAAA", "CNAME", "MX", "TXT"}
+
+// parseDNSCheck reads a dns://[resolver[:port]]/name?type=A&expect=v1,v2
+// URL. An empty resolver means the system's; type defaults to A.
+func parseDNSCheck(u *url.URL) (resolver, name, recordType string, err error) {
+	name = strings.Trim(u.Path, "/")
+	if name == "" {
+		return "", "", "", errors.New("dns url must name a host to resolve, e.g. dns://1.1.1.1/example.com")
+	}
+	recordType = strings.ToUpper(u.Query().Get("type"))
+	if recordType == "" {
+		recordType = "A"
+	}
+	if !slices.Contains(dnsRecordTypes, recordType) {
+		return "", "", "", fmt.Errorf("dns type must be one of %s", strings.Join(dnsRecordTypes, ", "))
+	}
+	resolver = u.Host
+	if resolver != "" && u.Port() == "" {
+		resolver = net.JoinHostPort(u.Hostname(), "53")
+	}
+	return resolver, name, recordType, nil
+}
+
+// normalizeDNSValue makes record values comparable: IPs in canonical form,
+// names lowercased without the trailing dot. TXT values are kept as is.
+func normalizeDNSValue(recordType, v string) string {
+	v = strings.TrimSpace(v)
+	switch recordType {
+	case "TXT":
+		return v
+	case "A", "AAAA":
+		if ip := net.ParseIP(v); ip != nil {
+			return ip.String()
+		}
+	}
+	return strings.ToLower(strings.TrimSuffix(v, "."))
+}
+
+// pingDNS resolves a dns:// project's name and times the lookup. The check
+// is DOWN when resolution fails (NXDOMAIN included) or when any value listed
+// in expect is missing from the answer.
+func pingDNS(p *Project, u *url.URL, cfg Config, timeout time.Duration, requestID string, store *Store, logger *slog.Logger) *Incident {
+	check := CheckResult{TS: time.Now().UnixMilli()}
+	fail := func(err error, category string) *Incident {
+		p.Status = "DOWN"
+		p.Latency = 0
+		check.Status = "DOWN"
+		check.Error = err.Error()
+		check.ErrorCategory = category
+		logger.Warn("ping failed", "project_id", p.ID, "project", p.Name, "error", check.Error, "category", category, "request_id", requestID)
+		return store.addCheck(*p, check)
+	}
+	resolverAddr, name, recordType, err := parseDNSCheck(u)
+	if err != nil {
+		return fail(err, "")
+	}
+
+	resolver := net.DefaultResolver
+	if resolverAddr != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, resolverAddr)
+			},
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	var values []string
+	switch recordType {
+	case "A", "AAAA":
+		network := "ip4"
+		if recordType == "AAAA" {
+			network = "ip6"
+		}
+		var ips []net.IP
+		ips, err = resolver.LookupIP(ctx, network, name)
+		for _, ip := range ips {
+			values = append(values, ip.String())
+		}
+	case "CNAME":
+		var cname string
+		cname, err = resolver.LookupCNAME(ctx, name)
+		values = []string{cname}
+	case "MX":
+		var mxs []*net.MX
+		mxs, err = resolver.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			values = append(values, mx.Host)
+		}
+	case "TXT":
+		values, err = resolver.LookupTXT(ctx, name)
+	}
+	latencyMs := time.Since(start).Milliseconds()
+	if err != nil {
+		return fail(err, errorCategory(err))
+	}
+
+	got := make([]string, len(values))
+	for i, v := range values {
+		got[i] = normalizeDNSValue(recordType, v)
+	}
+	for _, want := range strings.Split(u.Query().Get("expect"), ",") {
+		if want = normalizeDNSValue(recordType, want); want != "" && !slices.Contains(got, want) {
+			return fail(fmt.Errorf("%s %s: expected %q, got %q", recordType, name, want, strings.Join(got, ",")), "DNS_MISMATCH")
+		}
+	}
+	p.Latency = latencyMs
+	p.Status = classifyLatency(latencyMs, p, cfg)
+	check.Status = p.Status
+	check.LatencyMs = latencyMs
+	logger.Debug("ping ok", "project_id", p.ID, "status", p.Status, "latency_ms", p.Latency, "request_id", requestID)
+	return store.addCheck(*p, check)
+}
+
+// maxICMPCount caps the echo requests sent per ICMP check.
+const maxICMPCount = 20
+
+// pingICMP sends ICMP echo requests to an icmp://host project and reports
+// their mean round-trip time as latency. Every packet lost makes the check
+// DEGRADED, and DOWN when none came back. It prefers unprivileged ICMP
+// sockets (Linux needs net.ipv4.ping_group_range to cover the process) and
+// falls back to raw sockets, which need CAP_NET_RAW.
+func pingICMP(p *Project, host string, cfg Config, timeout time.Duration, requestID string, store *Store, logger *slog.Logger) *Incident {
+	count := cfg.ICMPCount
+	if p.ICMPCount > 0 {
+		count = min(p.ICMPCount, maxICMPCount)
+	}
+	rtts, err := probeICMP(host, max(count, 1), timeout)
+
+	check := CheckResult{TS: time.Now().UnixMilli()}
+	if len(rtts) == 0 {
+		if err == nil {
+			err = errors.New("no ICMP echo reply")
+		}
+		p.Status = "DOWN"
+		p.Latency = 0
+		check.Status = "DOWN"
+		check.Error = err.Error()
+		check.ErrorCategory = errorCategory(err)
+		logger.Warn("ping failed", "project_id", p.ID, "project", p.Name, "error", check.Error, "category", check.ErrorCategory, "request_id", requestID)
+		return store.addCheck(*p, check)
+	}
+	var total time.Duration
+	for _, rtt := range rtts {
+		total += rtt
+	}
+	p.Latency = (total / time.Duration(len(rtts))).Milliseconds()
+	p.Status = classifyLatency(p.Latency, p, cfg)
+	if len(rtts) < count {
+		p.Status = "DEGRADED"
+		check.Error = fmt.Sprintf("%d of %d ICMP echo requests lost", count-len(rtts), count)
+	}
+	check.Status = p.Status
+	check.LatencyMs = p.Latency
+	logger.Debug("ping ok", "project_id", p.ID, "status", p.Status, "latency_ms", p.Latency, "request_id", requestID)
+	return store.addCheck(*p, check)
+}
+
+// probeICMP sends count echo requests to host one after another, waiting up
+// to timeout for each reply, and returns the round-trip times of the replies
+// that arrived.
+func probeICMP(host string, count int, timeout time.Duration) ([]time.Duration, error) {
+	ip, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, err
+	}
+	v4 := ip.IP.To4() != nil
+	network, rawNetwork, listenAddr := "udp4", "ip4:icmp", "0.0.0.0"
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	proto := 1 // ICMP
+	if !v4 {
+		network, rawNetwork, listenAddr = "udp6", "ip6:ipv6-icmp", "::"
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		proto = 58 // ICMPv6
+	}
+	conn, err := icmp.ListenPacket(network, listenAddr)
+	var dst net.Addr = &net.UDPAddr{IP: ip.IP, Zone: ip.Zone}
+	if err != nil {
+		if conn, err = icmp.ListenPacket(rawNetwork, listenAddr); err != nil {
+			return nil, fmt.Errorf("open ICMP socket: %w", err)
+		}
+		dst = ip
+	}
+	defer conn.Close()
+
+	// Unprivileged sockets get their echo ID rewritten by the kernel, so
+	// replies are matched on sequence number and payload instead.
+	id := mathrand.IntN(0xffff)
+	payload := []byte("heartbeat-" + strconv.Itoa(id))
+	var rtts []time.Duration
+	buf := make([]byte, 1500)
+	for seq := 0; seq < count; seq++ {
+		msg := icmp.Message{Type: echoType, Body: &icmp.Echo{ID: id, Seq: seq, Data: payload}}
+		raw, err := msg.Marshal(nil)
+		if err != nil {
+			return rtts, err
+		}
+		start := time.Now()
+		if _, err := conn.WriteTo(raw, dst); err != nil {
+			return rtts, err
+		}
+		_ = conn.SetReadDeadline(start.Add(timeout))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break // timed out: this request counts as lost
+			}
+			reply, err := icmp.ParseMessage(proto, buf[:n])
+			if err != nil || reply.Type != replyType {
+				continue
+			}
+			if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == seq && bytes.Equal(echo.Data, payload) {
+				rtts = append(rtts, time.Since(start))
+				break
+			}
+		}
+	}
+	return rtts, nil
+}
+
+// probeGRPCHealth dials target and runs one health Check within timeout,
+// connection setup included.
+func probeGRPCHealth(target, service string, creds credentials.TransportCredentials, timeout time.Duration, requestID string) error {
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(requestIDHeader), requestID)
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return err
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("grpc health status %s", resp.GetStatus())
+	}
+	return nil
+}
+
+// supabaseError describes a failed project fetch. Status is the upstream
+// HTTP status, or 0 when Supabase could not be reached at all.
+type supabaseError struct {
+	Status int
+	Detail string
+}
+
+func (e *supabaseError) Error() string {
+	if e.Detail != "" {
+		return "invalid Supabase response: " + e.Detail
+	}
+	if e.Status == 0 {
+		return "Supabase connection error"
+	}
+	return "Supabase returned non-OK"
+}
+
+// Histogram is a minimal Prometheus-style histogram with cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(buckets ...float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// writeProm writes the histogram in the Prometheus text exposition format.
+func (h *Histogram) writeProm(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(le, 'f', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, strconv.FormatFloat(h.sum, 'f', -1, 64), name, h.count)
+}
+
+// supabaseFetchLatency records every Supabase projects roundtrip, failed or not.
+var supabaseFetchLatency = NewHistogram(10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000)
+
+// projectsQuery is the PostgREST query for the projects list. A tag keeps
+// only rows whose tags array contains it (the cs. operator), quoted as an
+// array literal so tags with commas, braces or quotes match exactly.
+func projectsQuery(tag string) string {
+	q := "select=*"
+	if tag != "" {
+		quoted := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(tag)
+		q += "&tags=cs." + url.QueryEscape(`{"`+quoted+`"}`)
+	}
+	return q
+}
+
+// fetchProjects lists the live projects, only those tagged tag when it is
+// not empty.
+func fetchProjects(cfg Config, tag string, logger *slog.Logger) ([]Project, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, _ := http.NewRequest("GET", cfg.SupabaseURL+"/rest/v1/projects?"+projectsQuery(tag), nil)
+	req.Header.Set("apikey", cfg.SupabaseAnonKey)
+	req.Header.Set("Authorization", "Bearer "+cfg.SupabaseAnonKey)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		supabaseFetchLatency.Observe(float64(time.Since(start).Milliseconds()))
+		return nil, &supabaseError{}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		supabaseFetchLatency.Observe(float64(time.Since(start).Milliseconds()))
+		return nil, &supabaseError{Status: resp.StatusCode}
+	}
+
+	// Decode row by row so one bad project doesn't blank the whole dashboard.
+	var rows []json.RawMessage
+	err = json.NewDecoder(resp.Body).Decode(&rows)
+	supabaseFetchLatency.Observe(float64(time.Since(start).Milliseconds()))
+	if err != nil {
+		return nil, &supabaseError{Status: resp.StatusCode, Detail: err.Error()}
+	}
+	live := make([]Project, 0, len(rows))
+	for i, row := range rows {
+		var p Project
+		if err := json.Unmarshal(row, &p); err != nil {
+			logger.Warn("skipping undecodable project row", "row", i, "error", err)
+			continue
+		}
+		if p.ID == "" || p.URL == "" {
+			logger.Warn("skipping project without id or url", "row", i, "project_id", p.ID)
+			continue
+		}
+		if p.Credentials == nil {
+			p.Credentials = basicAuthColumns(row)
+		}
+		if p.DeletedAt == nil {
+			live = append(live, p)
+		}
+	}
+	return live, nil
+}
 
-	// Generic webhook (JSON)
-	post(cfg.WebhookURL, body)
+// basicAuthColumns reads the flat basic_auth_user/basic_auth_pass columns as
+// basic Credentials, or nil when no user is set. They are kept out of Project
+// itself so the password is never serialised back through the API.
+func basicAuthColumns(row json.RawMessage) *Credentials {
+	var cols struct {
+		User string `json:"basic_auth_user"`
+		Pass string `json:"basic_auth_pass"`
+	}
+	if json.Unmarshal(row, &cols) != nil || cols.User == "" {
+		return nil
+	}
+	return &Credentials{Type: "basic", Username: cols.User, Password: cols.Pass}
+}
 
-	// Slack expects { "text": "..." }
-	if cfg.SlackWebhookURL != "" {
-		slackBody, _ := json.Marshal(map[string]string{
-			"text": fmt.Sprintf("*Heartbeat* %s — %s", incident.ProjectName, incident.Message),
-		})
-		post(cfg.SlackWebhookURL, slackBody)
+// projectWritableFields are the projects columns the management API may set.
+var projectWritableFields = map[string]bool{
+	"name":                   true,
+	"url":                    true,
+	"min_failures_to_alert":  true,
+	"degraded_ms":            true,
+	"slow_ms":                true,
+	"timeout_ms":             true,
+	"follow_redirects":       true,
+	"tags":                   true,
+	"enabled":                true,
+	"check_interval_seconds": true,
+	"sla_target":             true,
+	"icmp_count":             true,
+	"method":                 true,
+	"body":                   true,
+	"content_type":           true,
+	"headers":                true,
+	"keyword":                true,
+	"keyword_regex":          true,
+	"keyword_absent":         true,
+	"credentials":            true,
+	"basic_auth_user":        true,
+	"basic_auth_pass":        true,
+}
+
+// pingMethods are the HTTP methods a project check may use.
+var pingMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// Bounds for a project's check_interval_seconds; 0 uses CHECK_INTERVAL_SECONDS.
+const (
+	minProjectIntervalSecs = 5
+	maxProjectIntervalSecs = 86400
+)
+
+// validateProjectFields rejects unknown columns, URLs that aren't absolute
+// http(s) or grpc(s) URLs and out-of-range check intervals, trimming the URL
+// in place. For a partial update, existing is the stored row the fields are
+// merged into; it is nil for new projects.
+func validateProjectFields(fields map[string]any, existing *Project) error {
+	for k := range fields {
+		if !projectWritableFields[k] {
+			return fmt.Errorf("unknown field %q", k)
+		}
+	}
+	if raw, ok := fields["check_interval_seconds"]; ok && raw != nil {
+		secs, isNum := raw.(float64)
+		if !isNum || secs != math.Trunc(secs) || (secs != 0 && (secs < minProjectIntervalSecs || secs > maxProjectIntervalSecs)) {
+			return fmt.Errorf("check_interval_seconds must be 0 or a whole number from %d to %d", minProjectIntervalSecs, maxProjectIntervalSecs)
+		}
+	}
+	if raw, ok := fields["method"]; ok && raw != nil {
+		method, _ := raw.(string)
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method != "" && !slices.Contains(pingMethods, method) {
+			return fmt.Errorf("method must be one of %s", strings.Join(pingMethods, ", "))
+		}
+		fields["method"] = method
+	}
+	if raw, ok := fields["headers"]; ok && raw != nil {
+		headers, isObj := raw.(map[string]any)
+		if !isObj {
+			return errors.New("headers must be an object of header names to string values")
+		}
+		for name, v := range headers {
+			if _, isStr := v.(string); !isStr || name == "" || strings.ContainsAny(name, " \t\r\n:") {
+				return fmt.Errorf("invalid header %q", name)
+			}
+		}
+	}
+	// The keyword is checked as it will be stored, so changing only one of
+	// keyword, keyword_regex and method is validated against the others'
+	// current values.
+	var keyword, method string
+	var isRegex bool
+	if existing != nil {
+		keyword, isRegex, method = existing.Keyword, existing.KeywordRegex, strings.ToUpper(existing.Method)
+	}
+	if raw, ok := fields["keyword"]; ok {
+		keyword, _ = raw.(string)
+	}
+	if raw, ok := fields["keyword_regex"]; ok {
+		isRegex, _ = raw.(bool)
+	}
+	if raw, ok := fields["method"]; ok {
+		method, _ = raw.(string)
+	}
+	if isRegex && keyword != "" {
+		if _, err := regexp.Compile(keyword); err != nil {
+			return fmt.Errorf("keyword is not a valid regular expression: %v", err)
+		}
+	}
+	// A HEAD response has no body, so a keyword check would always fail.
+	if keyword != "" && method == http.MethodHead {
+		return errors.New("keyword checks need a response body; use a method other than HEAD")
+	}
+	if raw, ok := fields["sla_target"]; ok && raw != nil {
+		if pct, isNum := raw.(float64); !isNum || (pct != 0 && !validSLATarget(pct)) {
+			return errors.New("sla_target must be 0 or a percentage above 0 and below 100")
+		}
+	}
+	raw, ok := fields["url"]
+	if !ok {
+		return nil
 	}
+	str, _ := raw.(string)
+	str = strings.TrimSpace(str)
+	u, err := url.Parse(str)
+	if err != nil || !slices.Contains([]string{"http", "https", "grpc", "grpcs", "icmp", "dns"}, u.Scheme) || (u.Host == "" && u.Scheme != "dns") {
+		return errors.New("url must be an absolute http, https, grpc, grpcs, icmp or dns URL")
+	}
+	if u.Scheme == "dns" {
+		if _, _, _, err := parseDNSCheck(u); err != nil {
+			return err
+		}
+	}
+	fields["url"] = str
+	return nil
+}
 
-	// Discord expects { "content": "..." }
-	if cfg.DiscordWebhookURL != "" {
-		discordBody, _ := json.Marshal(map[string]string{
-			"content": fmt.Sprintf("**Heartbeat** %s — %s", incident.ProjectName, incident.Message),
+// writeProjects sends a write to the Supabase projects table with the
+// service-role key and returns the affected rows.
+func writeProjects(cfg Config, method, query string, body any) ([]Project, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest(method, cfg.SupabaseURL+"/rest/v1/projects"+query, bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=representation")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &supabaseError{}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, &supabaseError{Status: resp.StatusCode}
+	}
+	var rows []Project
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// fetchProject reads one live project row with the service role key, or nil
+// when there is none.
+func fetchProject(cfg Config, id string) (*Project, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest("GET", cfg.SupabaseURL+"/rest/v1/projects?select=*&id=eq."+url.QueryEscape(id)+"&deleted_at=is.null", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+cfg.SupabaseServiceRoleKey)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &supabaseError{}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, &supabaseError{Status: resp.StatusCode}
+	}
+	var rows []Project
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return &rows[0], nil
+}
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "CLOSED"
+	breakerOpen     = "OPEN"
+	breakerHalfOpen = "HALF_OPEN"
+)
+
+// CircuitBreaker guards fetchProjects. After enough consecutive failures it
+// opens and serves the last good project list instead of calling Supabase;
+// once the timeout passes a single probe is let through, and its outcome
+// closes or re-opens the breaker.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	lastErr  error
+	lastGood []Project
+}
+
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{state: breakerClosed}
+}
+
+// fetchProjects returns the project list (narrowed to tag when set), or the
+// cached last good list with stale=true while the breaker is open.
+// SUPABASE_CB_FAILURES=0 disables it.
+func (b *CircuitBreaker) fetchProjects(cfg Config, tag string, logger *slog.Logger) (projects []Project, stale bool, err error) {
+	b.mu.Lock()
+	if cfg.SupabaseCBFailures > 0 {
+		switch {
+		case b.state == breakerOpen && time.Since(b.openedAt) >= cfg.SupabaseCBTimeout:
+			// This caller is the probe; others keep getting the cache meanwhile.
+			b.state = breakerHalfOpen
+		case b.state != breakerClosed:
+			defer b.mu.Unlock()
+			return b.cachedLocked(tag)
+		}
+	}
+	b.mu.Unlock()
+
+	projects, err = fetchProjects(cfg, tag, logger)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.state = breakerClosed
+		b.failures = 0
+		if tag == "" {
+			b.lastGood = append([]Project(nil), projects...)
+		}
+		return projects, false, nil
+	}
+	b.failures++
+	b.lastErr = err
+	if cfg.SupabaseCBFailures > 0 && (b.state == breakerHalfOpen || b.failures >= cfg.SupabaseCBFailures) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		return b.cachedLocked(tag)
+	}
+	return nil, false, err
+}
+
+// cachedLocked returns a copy of the last good list, narrowed to tag when
+// set, or the last error when Supabase has never answered.
+func (b *CircuitBreaker) cachedLocked(tag string) ([]Project, bool, error) {
+	if b.lastGood == nil {
+		return nil, false, b.lastErr
+	}
+	out := make([]Project, 0, len(b.lastGood))
+	for _, p := range b.lastGood {
+		if tag == "" || slices.Contains(p.Tags, tag) {
+			out = append(out, p)
+		}
+	}
+	return out, true, nil
+}
+
+// scheduledProject is a Scheduler entry; index is its position in the heap.
+type scheduledProject struct {
+	project Project
+	next    time.Time
+	index   int
+}
+
+// scheduleHeap is a min-heap of projects ordered by next check time.
+type scheduleHeap []*scheduledProject
+
+func (h scheduleHeap) Len() int           { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *scheduleHeap) Push(x any) {
+	e := x.(*scheduledProject)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *scheduleHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Scheduler tracks when each project is next due for a check. It is a single
+// heap rather than a timer per project, so dropping a project from it is all
+// it takes to stop checking it.
+type Scheduler struct {
+	mu   sync.Mutex
+	heap scheduleHeap
+	byID map[string]*scheduledProject
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{byID: make(map[string]*scheduledProject)}
+}
+
+// projectInterval is the project's check interval, falling back to def.
+func projectInterval(p Project, def time.Duration) time.Duration {
+	if p.CheckIntervalSecs > 0 {
+		return time.Duration(p.CheckIntervalSecs) * time.Second
+	}
+	return def
+}
+
+// jittered delays d by a random share of up to frac of it, so projects with
+// the same interval drift apart instead of all firing together.
+func jittered(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration(mathrand.Float64()*frac*float64(d))
+}
+
+// reconcile syncs the schedule with a fresh project list: new projects are
+// due within the first jitter share of their interval, known ones keep their
+// next time (pulled in if their interval shrank), and removed or disabled
+// ones are dropped.
+func (s *Scheduler) reconcile(projects []Project, def time.Duration, jitter float64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool, len(projects))
+	for _, p := range projects {
+		if !p.isEnabled() {
+			continue
+		}
+		seen[p.ID] = true
+		if e, ok := s.byID[p.ID]; ok {
+			e.project = p
+			if latest := now.Add(projectInterval(p, def)); e.next.After(latest) {
+				e.next = latest
+				heap.Fix(&s.heap, e.index)
+			}
+			continue
+		}
+		// Spread first checks over the jitter share of the interval.
+		interval := projectInterval(p, def)
+		e := &scheduledProject{project: p, next: now.Add(jittered(interval, jitter) - interval)}
+		heap.Push(&s.heap, e)
+		s.byID[p.ID] = e
+	}
+	for id, e := range s.byID {
+		if !seen[id] {
+			heap.Remove(&s.heap, e.index)
+			delete(s.byID, id)
+		}
+	}
+}
+
+// popDue returns the projects due at now and schedules their next check.
+func (s *Scheduler) popDue(def time.Duration, jitter float64, now time.Time) []Project {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []Project
+	for len(s.heap) > 0 && !s.heap[0].next.After(now) {
+		e := s.heap[0]
+		due = append(due, e.project)
+		e.next = now.Add(jittered(projectInterval(e.project, def), jitter))
+		heap.Fix(&s.heap, 0)
+	}
+	return due
+}
+
+// size is the number of scheduled projects.
+func (s *Scheduler) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.heap)
+}
+
+// nextAt is when the earliest project is due, or zero when none are known.
+func (s *Scheduler) nextAt() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.heap) == 0 {
+		return time.Time{}
+	}
+	return s.heap[0].next
+}
+
+// runScheduler checks projects in the background at their own intervals,
+// refreshing the project list from Supabase every cfg.CheckInterval.
+func runScheduler(getCfg func() Config, breaker *CircuitBreaker, transport http.RoundTripper, store *Store, logger *slog.Logger) {
+	sched := store.scheduler
+	var lastFetch time.Time
+	for {
+		cfg := getCfg()
+		now := time.Now()
+		if now.Sub(lastFetch) >= cfg.CheckInterval {
+			projects, _, err := store.cachedProjects(func() ([]Project, bool, error) {
+				return breaker.fetchProjects(cfg, "", logger)
+			})
+			if err != nil {
+				logger.Warn("scheduler could not fetch projects", "error", err)
+			} else {
+				sched.reconcile(projects, cfg.CheckInterval, cfg.CheckJitter, now)
+			}
+			lastFetch = now
+		}
+		due := sched.popDue(cfg.CheckInterval, cfg.CheckJitter, now)
+		// Skipped targets keep their last result rather than recording DOWN.
+		due = slices.DeleteFunc(due, func(p Project) bool {
+			if store.allowProbe(p, projectInterval(p, cfg.CheckInterval), cfg.BackoffFailures, cfg.BackoffMax, now) {
+				return false
+			}
+			logger.Debug("check skipped by backoff", "project_id", p.ID)
+			return true
 		})
-		post(cfg.DiscordWebhookURL, discordBody)
+		if len(due) > 0 {
+			// Slow targets must not hold up the rest of the schedule.
+			go pingAll(due, cfg, transport, store, logger)
+		}
+		if cfg.EscalationInterval > 0 {
+			for _, reminder := range store.dueReminders(cfg.EscalationInterval, now) {
+				go notifyIncident(cfg, logger, store, reminder)
+			}
+		}
+
+		wake := lastFetch.Add(cfg.CheckInterval)
+		if next := sched.nextAt(); !next.IsZero() && next.Before(wake) {
+			wake = next
+		}
+		time.Sleep(max(time.Until(wake), 100*time.Millisecond))
 	}
 }
 
-func pingService(p *Project, cfg Config, store *Store, wg *sync.WaitGroup) {
-	defer wg.Done()
-	client := http.Client{Timeout: cfg.PingTimeout}
+// pingAll checks every enabled project concurrently, updating each in place.
+func pingAll(projects []Project, cfg Config, transport http.RoundTripper, store *Store, logger *slog.Logger) {
+	var wg sync.WaitGroup
+	incidents := make([]*Incident, len(projects))
+	for i := range projects {
+		if !projects[i].isEnabled() {
+			projects[i].Status = "DISABLED"
+			projects[i].Latency = 0
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			incidents[i] = pingService(&projects[i], cfg, transport, store, logger)
+		}(i)
+	}
+	wg.Wait()
 
-	var lastErr error
-	var lastCode int
-	var latencyMs int64
+	// While heartbeat looks isolated, one self-check incident replaces the
+	// per-project alerts.
+	selfCheck, isolated := store.trackIsolation(cfg.SelfCheckThreshold)
+	if selfCheck != nil {
+		go notifyIncident(cfg, logger, store, *selfCheck)
+	}
+	if isolated {
+		return
+	}
+	for _, incident := range incidents {
+		if incident != nil {
+			go notifyIncident(cfg, logger, store, *incident)
+		}
+	}
+}
 
-	for attempt := 0; attempt < cfg.PingRetries; attempt++ {
-		start := time.Now()
-		resp, err := client.Get(p.URL)
-		latencyMs = time.Since(start).Milliseconds()
-		if err == nil {
-			lastCode = resp.StatusCode
+var badgeTemplate = template.Must(template.New("badge").Parse(`<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="20" role="img" aria-label="{{.Label | html}}: {{.Message | html}}">
+<title>{{.Label | html}}: {{.Message | html}}</title>
+<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="{{.Width}}" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)">
+<rect width="{{.LabelWidth}}" height="20" fill="#555"/>
+<rect x="{{.LabelWidth}}" width="{{.MessageWidth}}" height="20" fill="{{.Color}}"/>
+<rect width="{{.Width}}" height="20" fill="url(#s)"/>
+</g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="{{.LabelX}}" y="14">{{.Label | html}}</text>
+<text x="{{.MessageX}}" y="14">{{.Message | html}}</text>
+</g>
+</svg>
+`))
+
+// renderBadge draws a shields.io-style flat badge. Text width is estimated
+// per character since there's no font metrics to measure against.
+func renderBadge(label, message, color string) []byte {
+	textWidth := func(t string) int { return 7*len([]rune(t)) + 10 }
+	lw, mw := textWidth(label), textWidth(message)
+	var buf strings.Builder
+	_ = badgeTemplate.Execute(&buf, map[string]any{
+		"Label":        label,
+		"Message":      message,
+		"Color":        color,
+		"Width":        lw + mw,
+		"LabelWidth":   lw,
+		"MessageWidth": mw,
+		"LabelX":       lw / 2,
+		"MessageX":     lw + mw/2,
+	})
+	return []byte(buf.String())
+}
+
+func badgeColor(status string) string {
+	switch status {
+	case "HEALTHY":
+		return "#4c1"
+	case "REDIRECT":
+		return "#007ec6"
+	case "SLOW":
+		return "#a4a61d"
+	case "DEGRADED":
+		return "#dfb317"
+	case "DOWN":
+		return "#e05d44"
+	default:
+		return "#9f9f9f"
+	}
+}
+
+// csvFilename derives a safe attachment name from a project ID.
+func csvFilename(projectID string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
 		}
-		if err == nil && resp.StatusCode < 400 {
-			lastErr = nil
-			break
+		return '_'
+	}, projectID)
+	return "history_" + safe + ".csv"
+}
+
+// startCSV sets the attachment headers and returns a writer straight onto
+// the response, so rows go out as they're written.
+func startCSV(c *gin.Context, filename string) *csv.Writer {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(200)
+	return csv.NewWriter(c.Writer)
+}
+
+// csvColumn is one column of a history CSV: its header and how to render a
+// check in it.
+type csvColumn struct {
+	name  string
+	value func(CheckResult) string
+}
+
+var (
+	csvTimestampMs = func(it CheckResult) string { return strconv.FormatInt(it.TS, 10) }
+	csvStatus      = func(it CheckResult) string { return it.Status }
+	csvLatency     = func(it CheckResult) string { return strconv.FormatInt(it.LatencyMs, 10) }
+	csvCode        = func(it CheckResult) string { return strconv.Itoa(it.Code) }
+	csvError       = func(it CheckResult) string { return it.Error }
+)
+
+// historyCSVColumns are served by /api/v1/history?format=csv and
+// exportCSVColumns by /api/v1/history/export.
+var (
+	historyCSVColumns = []csvColumn{
+		{"ts", csvTimestampMs},
+		{"ts_iso", func(it CheckResult) string { return time.UnixMilli(it.TS).UTC().Format(time.RFC3339) }},
+		{"status", csvStatus},
+		{"latency", csvLatency},
+		{"code", csvCode},
+		{"error", csvError},
+	}
+	exportCSVColumns = []csvColumn{
+		{"timestamp_ms", csvTimestampMs},
+		{"status", csvStatus},
+		{"latency_ms", csvLatency},
+		{"http_code", csvCode},
+		{"error", csvError},
+	}
+)
+
+// writeHistoryCSV streams checks as CSV for both /api/v1/history?format=csv
+// and /api/v1/history/export, keeping only those within the optional
+// start_ts/end_ts query bounds (unix ms, inclusive). encoding/csv takes care
+// of quoting commas and quotes in error messages.
+func writeHistoryCSV(c *gin.Context, projectID string, columns []csvColumn, items []CheckResult) {
+	var bounds [2]int64
+	for i, key := range []string{"start_ts", "end_ts"} {
+		if v := c.Query(key); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || ts < 0 {
+				c.JSON(400, gin.H{"error": "invalid " + key})
+				return
+			}
+			bounds[i] = ts
 		}
-		lastErr = err
-		if attempt < cfg.PingRetries-1 && cfg.PingRetryDelay > 0 {
-			time.Sleep(cfg.PingRetryDelay)
+	}
+
+	w := startCSV(c, csvFilename(projectID))
+	record := make([]string, len(columns))
+	for i, col := range columns {
+		record[i] = col.name
+	}
+	_ = w.Write(record)
+	rows := 0
+	for _, it := range items {
+		if (bounds[0] > 0 && it.TS < bounds[0]) || (bounds[1] > 0 && it.TS > bounds[1]) {
+			continue
+		}
+		for i, col := range columns {
+			record[i] = col.value(it)
+		}
+		_ = w.Write(record)
+		if rows++; rows%100 == 0 {
+			w.Flush()
 		}
 	}
+	w.Flush()
+}
 
-	p.Latency = latencyMs
-	if lastErr != nil || lastCode >= 400 {
-		p.Status = "DOWN"
-		p.Latency = 0
-		check := CheckResult{
-			TS:        time.Now().UnixMilli(),
-			Status:    "DOWN",
-			LatencyMs: 0,
-			Code:      lastCode,
+func main() {
+	configFile := flag.String("config", "", "path to a YAML or JSON config file (overrides CONFIG_FILE)")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		panic(err)
+	}
+
+	live := &liveConfig{cfg: &cfg}
+	getCfg := live.get
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(cfg.LogLevel)
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
+
+	store, err := NewStore(cfg, logger)
+	if err != nil {
+		panic(err)
+	}
+	pingTransport := newPingTransport(cfg.PingForceHTTP2, cfg.PingMinTLS)
+	supabaseBreaker := NewCircuitBreaker()
+	if cfg.CheckInterval > 0 {
+		go runScheduler(getCfg, supabaseBreaker, pingTransport, store, logger)
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			next, err := reloadConfig(*configFile)
+			if err != nil {
+				logger.Error("config reload failed; keeping running config", "error", err)
+				continue
+			}
+			keepStartupOnlySettings(logger, getCfg(), &next)
+			store.applyConfig(next)
+			logLevel.Set(next.LogLevel)
+			live.set(next)
+			logger.Info("config reloaded")
 		}
-		if lastErr != nil {
-			check.Error = lastErr.Error()
+	}()
+
+	r := newRouter(getCfg, store, supabaseBreaker, pingTransport, logger)
+	r.Run(":" + cfg.Port)
+}
+
+// newRouter registers the HTTP API. getCfg returns the live config, so
+// routes pick up SIGHUP reloads without being registered again.
+func newRouter(getCfg func() Config, store *Store, supabaseBreaker *CircuitBreaker, pingTransport *http.Transport, logger *slog.Logger) *gin.Engine {
+	// No gin.Logger: RequestIDMiddleware writes the one structured line per
+	// request. Recovery runs inside it so recovered panics are logged as 500s.
+	r := gin.New()
+	// Gin trusts X-Forwarded-For from any peer by default, which would let
+	// clients spoof their way past IP_ALLOWLIST and the per-IP limits.
+	// loadConfig already validated the entries.
+	if err := r.SetTrustedProxies(getCfg().TrustedProxies); err != nil {
+		panic(err)
+	}
+	r.Use(RequestIDMiddleware(logger), gin.Recovery())
+	r.Use(func(c *gin.Context) {
+		CORSMiddleware(getCfg().CORSOrigins)(c)
+	})
+	// Guards the data endpoints; health, summary, badge and the confirm flow
+	// stay public.
+	requireAPIKey := func(c *gin.Context) {
+		APIKeyMiddleware(getCfg().APIKey)(c)
+	}
+	// Auth and admin routes can additionally be limited to IP_ALLOWLIST.
+	requireAllowedIP := func(c *gin.Context) {
+		IPAllowlistMiddleware(getCfg().IPAllowlist)(c)
+	}
+	// Destructive and alert-sending admin routes stay closed until API_KEY
+	// is set, rather than being open like the read endpoints.
+	requireAdminKey := func(c *gin.Context) {
+		if getCfg().APIKey == "" {
+			c.AbortWithStatusJSON(503, gin.H{"error": "this endpoint requires API_KEY"})
+			return
+		}
+		requireAPIKey(c)
+	}
+	apiRateLimit := func(c *gin.Context) {
+		cfg := getCfg()
+		RateLimitMiddleware(store, cfg.APIRateLimit, cfg.APIRateWindow)(c)
+	}
+
+	// The debug route only exists when DEBUG_TOKEN is set at startup.
+	if getCfg().DebugToken != "" {
+		startedAt := time.Now()
+		r.GET("/debug/store", requireAllowedIP, func(c *gin.Context) {
+			if !hmac.Equal([]byte(c.Query("token")), []byte(getCfg().DebugToken)) {
+				c.JSON(403, gin.H{"error": "forbidden"})
+				return
+			}
+			gogc := os.Getenv("GOGC")
+			if gogc == "" {
+				gogc = "100"
+			}
+			c.JSON(200, gin.H{
+				"store":      store.debugStats(),
+				"uptimeMs":   time.Since(startedAt).Milliseconds(),
+				"gogc":       gogc,
+				"gomaxprocs": runtime.GOMAXPROCS(0),
+			})
+		})
+	}
+
+	r.GET("/", func(c *gin.Context) {
+		c.JSON(200, gin.H{
+			"name":  "heartbeat-backend",
+			"ok":    true,
+			"routes": []string{"/api/v1/health", "/api/v1/ready", "/api/v1/status", "/api/v1/projects", "/api/v1/incidents", "/api/v1/incidents/stats", "/api/v1/mttr", "/api/v1/sla", "/api/v1/timeline", "/api/v1/history", "/api/v1/history/bulk", "/api/v1/summary", "/api/v1/groups", "/api/v1/badge", "/metrics"},
+		})
+	})
+
+	r.GET("/api/v1/health", func(c *gin.Context) {
+		c.JSON(200, gin.H{"ok": true})
+	})
+
+	r.GET("/api/v1/ready", func(c *gin.Context) {
+		cfg := getCfg()
+		if err := checkSupabaseReady(cfg); err != nil {
+			c.JSON(503, gin.H{"ok": false, "error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"ok": true})
+	})
+
+	r.GET("/api/v1/status", apiRateLimit, requireAPIKey, func(c *gin.Context) {
+		cfg := getCfg()
+		// A tag is filtered by Supabase so only those projects are checked;
+		// tagged lists bypass the shared project and status caches.
+		tag := strings.TrimSpace(c.Query("tag"))
+		refresh := func() ([]Project, time.Duration, error) {
+			start := time.Now()
+			fetch := func() ([]Project, bool, error) {
+				return supabaseBreaker.fetchProjects(cfg, tag, logger)
+			}
+			var projects []Project
+			var stale bool
+			var err error
+			if tag == "" {
+				projects, stale, err = store.cachedProjects(fetch)
+			} else {
+				projects, stale, err = fetch()
+			}
+			fetchTime := time.Since(start)
+			if err != nil {
+				return nil, fetchTime, err
+			}
+			for i := range projects {
+				projects[i].Stale = stale
+			}
+			// With the background scheduler running, /status only reports its
+			// latest results; otherwise it checks on demand.
+			if cfg.CheckInterval > 0 {
+				store.fillLatest(projects)
+			} else {
+				pingAll(projects, cfg, pingTransport, store, logger)
+			}
+			store.fillLastHealthy(projects)
+			return projects, fetchTime, nil
+		}
+		var projects []Project
+		var fetchTime time.Duration
+		var err error
+		if tag == "" {
+			projects, fetchTime, err = store.cachedStatus(cfg.StatusCacheTTL, refresh)
+		} else {
+			projects, fetchTime, err = refresh()
+		}
+		if err != nil {
+			var se *supabaseError
+			if errors.As(err, &se) && se.Detail != "" {
+				c.JSON(502, gin.H{"error": se.Error()})
+				return
+			}
+			if errors.As(err, &se) && se.Status != 0 {
+				c.JSON(500, gin.H{"error": se.Error(), "status": se.Status})
+				return
+			}
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
 		}
-		if incident := store.addCheck(*p, check); incident != nil {
-			go doWebhook(cfg, *incident)
+		// The body stays a bare array for existing clients; the fetch time
+		// rides along as a header.
+		c.Header("X-Supabase-Latency-Ms", strconv.FormatInt(fetchTime.Milliseconds(), 10))
+		c.JSON(200, projects)
+	})
+
+	r.GET("/metrics", requireAPIKey, func(c *gin.Context) {
+		c.Header("Content-Type", "text/plain; version=0.0.4")
+		supabaseFetchLatency.writeProm(c.Writer, "heartbeat_supabase_fetch_latency_ms", "Supabase projects fetch roundtrip in milliseconds.")
+	})
+
+	r.GET("/api/v1/status/diff", apiRateLimit, requireAPIKey, func(c *gin.Context) {
+		since, err := strconv.ParseInt(c.Query("since_ts"), 10, 64)
+		if err != nil || since < 0 {
+			c.JSON(400, gin.H{"error": "since_ts must be a unix millisecond timestamp"})
+			return
 		}
-		return
-	}
+		projects, serverTS := store.statusDiff(since)
+		c.JSON(200, gin.H{"server_ts": serverTS, "projects": projects})
+	})
 
-	if p.Latency >= cfg.DegradedMs {
-		p.Status = "DEGRADED"
-	} else {
-		p.Status = "HEALTHY"
-	}
-	check := CheckResult{
-		TS:        time.Now().UnixMilli(),
-		Status:    p.Status,
-		LatencyMs: p.Latency,
-		Code:      lastCode,
-	}
-	if incident := store.addCheck(*p, check); incident != nil {
-		go doWebhook(cfg, *incident)
+	// Project management writes through to Supabase with the service-role key,
+	// so it is only enabled when API_KEY guards it.
+	requireProjectWrites := func(c *gin.Context) {
+		cfg := getCfg()
+		if cfg.SupabaseServiceRoleKey == "" || cfg.APIKey == "" {
+			c.AbortWithStatusJSON(503, gin.H{"error": "project management requires SUPABASE_SERVICE_ROLE_KEY and API_KEY"})
+			return
+		}
+		requireAPIKey(c)
 	}
-}
-
-func main() {
-	cfg, err := loadConfig()
-	if err != nil {
-		panic(err)
+	projectWriteError := func(c *gin.Context, err error) {
+		var se *supabaseError
+		if errors.As(err, &se) && se.Status != 0 {
+			c.JSON(502, gin.H{"error": se.Error(), "status": se.Status})
+			return
+		}
+		c.JSON(502, gin.H{"error": err.Error()})
 	}
 
-	r := gin.Default()
-	r.Use(CORSMiddleware(cfg.CORSOrigin))
-	store := NewStore(cfg)
-
-	r.GET("/", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"name":  "heartbeat-backend",
-			"ok":    true,
-			"routes": []string{"/api/v1/health", "/api/v1/status", "/api/v1/incidents", "/api/v1/history"},
+	// The project list as fetched for /status, without pinging.
+	r.GET("/api/v1/projects", apiRateLimit, requireAPIKey, func(c *gin.Context) {
+		cfg := getCfg()
+		projects, stale, err := store.cachedProjects(func() ([]Project, bool, error) {
+			return supabaseBreaker.fetchProjects(cfg, "", logger)
 		})
+		if err != nil {
+			projectWriteError(c, err)
+			return
+		}
+		c.JSON(200, gin.H{"stale": stale, "projects": projects})
 	})
 
-	r.GET("/api/v1/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"ok": true})
+	r.POST("/api/v1/projects", requireAllowedIP, requireProjectWrites, func(c *gin.Context) {
+		var fields map[string]any
+		if err := c.BindJSON(&fields); err != nil {
+			c.JSON(400, gin.H{"error": "invalid json"})
+			return
+		}
+		if name, _ := fields["name"].(string); strings.TrimSpace(name) == "" {
+			c.JSON(400, gin.H{"error": "name is required"})
+			return
+		}
+		if _, ok := fields["url"]; !ok {
+			c.JSON(400, gin.H{"error": "url is required"})
+			return
+		}
+		if err := validateProjectFields(fields, nil); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		rows, err := writeProjects(getCfg(), "POST", "", fields)
+		if err != nil {
+			projectWriteError(c, err)
+			return
+		}
+		store.invalidateStatus()
+		if len(rows) == 0 {
+			c.JSON(201, gin.H{"ok": true})
+			return
+		}
+		c.JSON(201, rows[0])
 	})
 
-	r.GET("/api/v1/status", func(c *gin.Context) {
-		client := &http.Client{Timeout: 10 * time.Second}
-		req, _ := http.NewRequest("GET", cfg.SupabaseURL+"/rest/v1/projects?select=*", nil)
-		req.Header.Set("apikey", cfg.SupabaseAnonKey)
-		req.Header.Set("Authorization", "Bearer "+cfg.SupabaseAnonKey)
-
-		resp, err := client.Do(req)
+	// PUT is accepted as an alias of PATCH: only the given fields change.
+	updateProject := func(c *gin.Context) {
+		var fields map[string]any
+		if err := c.BindJSON(&fields); err != nil {
+			c.JSON(400, gin.H{"error": "invalid json"})
+			return
+		}
+		if len(fields) == 0 {
+			c.JSON(400, gin.H{"error": "no fields to update"})
+			return
+		}
+		var existing *Project
+		rawKeyword, setsKeyword := fields["keyword"]
+		_, setsRegex := fields["keyword_regex"]
+		rawMethod, setsMethod := fields["method"]
+		keyword, _ := rawKeyword.(string)
+		method, _ := rawMethod.(string)
+		// Validation needs the stored keyword settings or method whenever
+		// the update only changes part of them.
+		if setsKeyword != setsRegex ||
+			(keyword != "" && !setsMethod) ||
+			(strings.EqualFold(strings.TrimSpace(method), http.MethodHead) && !setsKeyword) {
+			var err error
+			existing, err = fetchProject(getCfg(), c.Param("id"))
+			if err != nil {
+				projectWriteError(c, err)
+				return
+			}
+			if existing == nil {
+				c.JSON(404, gin.H{"error": "project not found"})
+				return
+			}
+		}
+		if err := validateProjectFields(fields, existing); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		rows, err := writeProjects(getCfg(), "PATCH", "?id=eq."+url.QueryEscape(c.Param("id"))+"&deleted_at=is.null", fields)
 		if err != nil {
-			c.JSON(500, gin.H{"error": "Supabase connection error"})
+			projectWriteError(c, err)
 			return
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode >= 400 {
-			c.JSON(500, gin.H{"error": "Supabase returned non-OK", "status": resp.StatusCode})
+		if len(rows) == 0 {
+			c.JSON(404, gin.H{"error": "project not found"})
 			return
 		}
+		store.invalidateStatus()
+		c.JSON(200, rows[0])
+	}
+	r.PATCH("/api/v1/projects/:id", requireAllowedIP, requireProjectWrites, updateProject)
+	r.PUT("/api/v1/projects/:id", requireAllowedIP, requireProjectWrites, updateProject)
 
-		var projects []Project
-		json.NewDecoder(resp.Body).Decode(&projects)
-
-		var wg sync.WaitGroup
-		for i := range projects {
-			wg.Add(1)
-			go pingService(&projects[i], cfg, store, &wg)
+	r.DELETE("/api/v1/projects/:id", requireAllowedIP, requireProjectWrites, func(c *gin.Context) {
+		// Soft delete: the row stays for history but fetchProjects skips it.
+		deletedAt := time.Now().UTC().Format(time.RFC3339)
+		rows, err := writeProjects(getCfg(), "PATCH", "?id=eq."+url.QueryEscape(c.Param("id"))+"&deleted_at=is.null", map[string]any{"deleted_at": deletedAt})
+		if err != nil {
+			projectWriteError(c, err)
+			return
 		}
-		wg.Wait()
+		if len(rows) == 0 {
+			c.JSON(404, gin.H{"error": "project not found"})
+			return
+		}
+		store.invalidateStatus()
+		c.JSON(200, gin.H{"ok": true, "id": c.Param("id"), "deletedAt": deletedAt})
+	})
 
-		c.JSON(200, projects)
+	r.DELETE("/api/v1/projects/:id/history", requireAllowedIP, apiRateLimit, requireAdminKey, func(c *gin.Context) {
+		deleted, prevStatus := store.Reset(c.Param("id"))
+		store.invalidateStatus()
+		c.JSON(200, gin.H{"ok": true, "id": c.Param("id"), "deleted": deleted, "previousStatus": prevStatus})
 	})
 
-	r.POST("/api/v1/auth/send-confirmation", func(c *gin.Context) {
+	r.POST("/api/v1/auth/send-confirmation", requireAllowedIP, func(c *gin.Context) {
+		cfg := getCfg()
 		var req struct {
 			Email    string `json:"email"`
 			Username string `json:"username"`
@@ -587,12 +5760,16 @@ func main() {
 			c.JSON(400, gin.H{"error": "invalid json"})
 			return
 		}
-		email := strings.TrimSpace(req.Email)
 		username := strings.TrimSpace(req.Username)
-		if email == "" || !strings.Contains(email, "@") {
+		if strings.TrimSpace(req.Email) == "" {
 			c.JSON(400, gin.H{"error": "email is required"})
 			return
 		}
+		email, err := normalizeEmail(req.Email)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
 		if store.isConfirmed(email) {
 			c.JSON(200, gin.H{"ok": true, "alreadyConfirmed": true})
 			return
@@ -600,11 +5777,15 @@ func main() {
 
 		// Basic rate limiting to reduce abuse when EmailJS is called from the browser.
 		ip := c.ClientIP()
-		if !store.allowAction("confirm:ip:"+ip, 1*time.Minute, 10) {
+		ipLimit := store.allowAction("confirm:ip:"+ip, 1*time.Minute, 10)
+		if !ipLimit.Allowed {
+			setRateLimitHeaders(c, ipLimit)
 			c.JSON(429, gin.H{"ok": false, "error": "too many requests"})
 			return
 		}
-		if !store.allowAction("confirm:email:"+strings.ToLower(email), 10*time.Minute, 5) {
+		emailLimit := store.allowAction("confirm:email:"+strings.ToLower(email), 10*time.Minute, 5)
+		setRateLimitHeaders(c, ipLimit, emailLimit)
+		if !emailLimit.Allowed {
 			c.JSON(429, gin.H{"ok": false, "error": "too many requests"})
 			return
 		}
@@ -633,22 +5814,135 @@ func main() {
 		c.JSON(200, gin.H{"ok": true, "expiresAt": exp, "confirmLink": confirmLink})
 	})
 
-	r.GET("/api/v1/auth/confirm", func(c *gin.Context) {
+	r.GET("/api/v1/auth/confirm", requireAllowedIP, func(c *gin.Context) {
+		cfg := getCfg()
 		token := strings.TrimSpace(c.Query("token"))
 		if token == "" {
 			c.JSON(400, gin.H{"error": "token is required"})
 			return
 		}
-		ct, ok := verifyConfirmToken(cfg.ConfirmTokenSecret, token)
-		if !ok {
+		ct, ok := verifyConfirmToken(cfg.confirmSecrets(), token)
+		if !ok || ct.Action != "" || ct.Nonce == "" {
 			c.JSON(400, gin.H{"ok": false, "error": "invalid or expired token"})
 			return
 		}
-		store.markConfirmed(ct.Email)
+		if !store.confirmWithNonce(ct.Email, ct.Nonce, ct.Exp) {
+			c.JSON(400, gin.H{"ok": false, "error": "token already used"})
+			return
+		}
 		c.JSON(200, gin.H{"ok": true, "email": ct.Email, "username": ct.Username})
 	})
 
-	r.GET("/api/v1/auth/is-confirmed", func(c *gin.Context) {
+	r.POST("/api/v1/auth/revoke", requireAllowedIP, func(c *gin.Context) {
+		cfg := getCfg()
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "invalid json"})
+			return
+		}
+		token := strings.TrimSpace(req.Token)
+		if token == "" {
+			c.JSON(400, gin.H{"error": "token is required"})
+			return
+		}
+		ct, ok := verifyConfirmToken(cfg.confirmSecrets(), token)
+		if !ok || ct.Action != "" || ct.Nonce == "" {
+			c.JSON(400, gin.H{"ok": false, "error": "invalid or expired token"})
+			return
+		}
+		// The same confirmation token may still revoke once after it was used
+		// to confirm, so revocations track its nonce separately.
+		if !store.consumeNonce("revoke:"+ct.Nonce, ct.Exp) {
+			c.JSON(400, gin.H{"ok": false, "error": "token already used"})
+			return
+		}
+		revoked := store.removeConfirmed(ct.Email)
+		c.JSON(200, gin.H{"ok": true, "revoked": revoked, "email": ct.Email})
+	})
+
+	r.GET("/api/v1/auth/send-unsubscribe", requireAllowedIP, func(c *gin.Context) {
+		cfg := getCfg()
+		if strings.TrimSpace(c.Query("email")) == "" {
+			c.JSON(400, gin.H{"error": "email is required"})
+			return
+		}
+		email, err := normalizeEmail(c.Query("email"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if !store.isConfirmed(email) {
+			c.JSON(200, gin.H{"ok": true, "notSubscribed": true})
+			return
+		}
+
+		ip := c.ClientIP()
+		ipLimit := store.allowAction("unsubscribe:ip:"+ip, 1*time.Minute, 10)
+		if !ipLimit.Allowed {
+			setRateLimitHeaders(c, ipLimit)
+			c.JSON(429, gin.H{"ok": false, "error": "too many requests"})
+			return
+		}
+		emailLimit := store.allowAction("unsubscribe:email:"+strings.ToLower(email), 10*time.Minute, 5)
+		setRateLimitHeaders(c, ipLimit, emailLimit)
+		if !emailLimit.Allowed {
+			c.JSON(429, gin.H{"ok": false, "error": "too many requests"})
+			return
+		}
+
+		nonce, err := randomNonce()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "could not create token"})
+			return
+		}
+		exp := time.Now().Add(time.Duration(cfg.ConfirmTokenTTLMinutes) * time.Minute).Unix()
+		token, err := signConfirmToken(cfg.ConfirmTokenSecret, ConfirmTokenPayload{
+			Email:  email,
+			Exp:    exp,
+			Nonce:  nonce,
+			Action: "unsubscribe",
+		})
+		if err != nil {
+			c.JSON(500, gin.H{"error": "could not create token"})
+			return
+		}
+		unsubscribeLink := cfg.ConfirmBaseURL + "/unsubscribe?token=" + url.QueryEscape(token) + "&email=" + url.QueryEscape(email)
+		// Sent from the browser via EmailJS, like the confirmation link.
+		c.JSON(200, gin.H{"ok": true, "expiresAt": exp, "unsubscribeLink": unsubscribeLink})
+	})
+
+	r.POST("/api/v1/auth/unsubscribe", requireAllowedIP, func(c *gin.Context) {
+		cfg := getCfg()
+		var req struct {
+			Email string `json:"email"`
+			Token string `json:"token"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "invalid json"})
+			return
+		}
+		email := strings.TrimSpace(req.Email)
+		token := strings.TrimSpace(req.Token)
+		if email == "" || token == "" {
+			c.JSON(400, gin.H{"error": "email and token are required"})
+			return
+		}
+		ct, ok := verifyConfirmToken(cfg.confirmSecrets(), token)
+		if !ok || ct.Action != "unsubscribe" || !strings.EqualFold(strings.TrimSpace(ct.Email), email) {
+			c.JSON(400, gin.H{"ok": false, "error": "invalid or expired token"})
+			return
+		}
+		if !store.consumeNonce("unsubscribe:"+ct.Nonce, ct.Exp) {
+			c.JSON(400, gin.H{"ok": false, "error": "token already used"})
+			return
+		}
+		removed := store.removeConfirmed(ct.Email)
+		c.JSON(200, gin.H{"ok": true, "unsubscribed": removed, "email": ct.Email})
+	})
+
+	r.GET("/api/v1/auth/is-confirmed", requireAllowedIP, func(c *gin.Context) {
 		email := strings.TrimSpace(c.Query("email"))
 		if email == "" {
 			c.JSON(400, gin.H{"error": "email is required"})
@@ -657,7 +5951,11 @@ func main() {
 		c.JSON(200, gin.H{"ok": true, "confirmed": store.isConfirmed(email)})
 	})
 
-	r.GET("/api/v1/history", func(c *gin.Context) {
+	r.GET("/api/v1/auth/confirmed-count", requireAllowedIP, apiRateLimit, requireAPIKey, func(c *gin.Context) {
+		c.JSON(200, store.confirmedStats())
+	})
+
+	r.GET("/api/v1/history", apiRateLimit, requireAPIKey, func(c *gin.Context) {
 		projectID := strings.TrimSpace(c.Query("project_id"))
 		if projectID == "" {
 			c.JSON(400, gin.H{"error": "project_id is required"})
@@ -669,18 +5967,303 @@ func main() {
 				limit = lim
 			}
 		}
-		c.JSON(200, gin.H{"projectId": projectID, "items": store.getHistory(projectID, limit)})
+		resolution, ok := historyResolutions[c.DefaultQuery("resolution", "raw")]
+		if !ok {
+			c.JSON(400, gin.H{"error": "resolution must be one of raw, 1m, 5m, 1h, 1d"})
+			return
+		}
+		items := store.getHistory(projectID, limit, resolution)
+		if c.Query("format") == "csv" {
+			writeHistoryCSV(c, projectID, historyCSVColumns, items)
+			return
+		}
+		resp := gin.H{"projectId": projectID, "items": items}
+		if c.Query("stats") == "true" {
+			// Bucket means would flatten the tail, so downsampled responses
+			// take percentiles over the raw checks the buckets cover.
+			raw := items
+			if resolution > 0 && len(items) > 0 {
+				raw = slices.DeleteFunc(store.getHistory(projectID, 0, 0), func(r CheckResult) bool {
+					return r.TS < items[0].TS
+				})
+			}
+			resp["percentiles"] = store.latencyPercentiles(raw)
+		}
+		c.JSON(200, resp)
+	})
+
+	// Sparkline data for many projects in one round trip.
+	r.GET("/api/v1/history/bulk", apiRateLimit, requireAPIKey, func(c *gin.Context) {
+		var ids []string
+		for _, id := range strings.Split(c.Query("project_ids"), ",") {
+			if id = strings.TrimSpace(id); id != "" && !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			c.JSON(400, gin.H{"error": "project_ids is required"})
+			return
+		}
+		if len(ids) > maxBulkHistoryProjects {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("at most %d project_ids per request", maxBulkHistoryProjects)})
+			return
+		}
+		limit := 48
+		if limStr := c.Query("limit"); limStr != "" {
+			if lim, err := strconv.Atoi(limStr); err == nil && lim > 0 && lim <= 500 {
+				limit = lim
+			}
+		}
+		resolution, ok := historyResolutions[c.DefaultQuery("resolution", "raw")]
+		if !ok {
+			c.JSON(400, gin.H{"error": "resolution must be one of raw, 1m, 5m, 1h, 1d"})
+			return
+		}
+		items := make(map[string][]CheckResult, len(ids))
+		for _, id := range ids {
+			items[id] = store.getHistory(id, limit, resolution)
+		}
+		c.JSON(200, gin.H{"items": items})
+	})
+
+	// Every retained check, unlike /api/v1/history?format=csv which is
+	// capped by limit.
+	r.GET("/api/v1/history/export", apiRateLimit, requireAPIKey, func(c *gin.Context) {
+		projectID := strings.TrimSpace(c.Query("project_id"))
+		if projectID == "" {
+			c.JSON(400, gin.H{"error": "project_id is required"})
+			return
+		}
+		writeHistoryCSV(c, projectID, exportCSVColumns, store.getHistory(projectID, 0, 0))
+	})
+
+	r.GET("/api/v1/summary", func(c *gin.Context) {
+		window, err := parseWindow(c.DefaultQuery("window", "24h"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		// Incident details stay behind API_KEY like /api/v1/incidents; the
+		// public roll-up only carries counts.
+		recent := 0
+		if hasAPIKey(c, getCfg().APIKey) {
+			recent = 5
+			if limStr := c.Query("limit"); limStr != "" {
+				if lim, err := strconv.Atoi(limStr); err == nil && lim >= 0 && lim <= 50 {
+					recent = lim
+				}
+			}
+		}
+		if recent > 0 {
+			c.Header("Cache-Control", "private, max-age=30")
+		} else {
+			c.Header("Cache-Control", "public, max-age=30")
+		}
+		c.JSON(200, store.summary(30*time.Second, window, recent, strings.TrimSpace(c.Query("tag"))))
+	})
+
+	r.GET("/api/v1/groups", func(c *gin.Context) {
+		c.JSON(200, gin.H{"groups": store.groups()})
+	})
+
+	r.GET("/api/v1/badge", func(c *gin.Context) {
+		label, message, color := "heartbeat", "no data", badgeColor("")
+		if status, name, ok := store.latestStatus(strings.TrimSpace(c.Query("project_id"))); ok {
+			if name != "" {
+				label = name
+			}
+			message, color = strings.ToLower(status), badgeColor(status)
+		}
+		// Short max-age so GitHub's camo proxy picks up status changes quickly.
+		c.Header("Cache-Control", "public, max-age=60, must-revalidate")
+		c.Data(200, "image/svg+xml; charset=utf-8", renderBadge(label, message, color))
+	})
+
+	// Acknowledging silences a project's alerts, so only key holders may do
+	// it; "by" is therefore always recorded from an authenticated caller.
+	r.POST("/api/v1/incidents/:id/ack", requireAllowedIP, requireAdminKey, func(c *gin.Context) {
+		var req struct {
+			By string `json:"by"`
+		}
+		// The body is optional; an empty one just acknowledges anonymously.
+		if c.Request.ContentLength != 0 {
+			if err := c.BindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": "invalid json"})
+				return
+			}
+		}
+		incident, err := store.acknowledgeIncident(c.Param("id"), strings.TrimSpace(req.By))
+		switch {
+		case errors.Is(err, errIncidentNotFound):
+			c.JSON(404, gin.H{"error": "incident not found"})
+		case errors.Is(err, errIncidentResolved):
+			c.JSON(409, gin.H{"error": "incident already resolved"})
+		default:
+			c.JSON(200, gin.H{"ok": true, "incident": incident})
+		}
 	})
 
-	r.GET("/api/v1/incidents", func(c *gin.Context) {
+	r.GET("/api/v1/incidents", apiRateLimit, requireAPIKey, func(c *gin.Context) {
 		limit := 50
 		if limStr := c.Query("limit"); limStr != "" {
 			if lim, err := strconv.Atoi(limStr); err == nil && lim > 0 && lim <= 200 {
 				limit = lim
 			}
 		}
-		c.JSON(200, gin.H{"items": store.getIncidents(limit)})
+		status := strings.ToUpper(strings.TrimSpace(c.Query("status")))
+		severity := strings.ToLower(strings.TrimSpace(c.Query("severity")))
+		if severity != "" && severityRank(severity) == 0 {
+			c.JSON(400, gin.H{"error": "invalid severity"})
+			return
+		}
+		c.JSON(200, gin.H{"items": store.getIncidents(limit, status, severity)})
+	})
+
+	r.GET("/api/v1/sla", apiRateLimit, requireAPIKey, func(c *gin.Context) {
+		cfg := getCfg()
+		projectID := strings.TrimSpace(c.Query("project_id"))
+		if projectID == "" {
+			c.JSON(400, gin.H{"error": "project_id is required"})
+			return
+		}
+		window, err := parseWindow(c.DefaultQuery("window", "30d"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		projects, _, err := store.cachedProjects(func() ([]Project, bool, error) {
+			return supabaseBreaker.fetchProjects(cfg, "", logger)
+		})
+		if err != nil {
+			c.JSON(502, gin.H{"error": err.Error()})
+			return
+		}
+		i := slices.IndexFunc(projects, func(p Project) bool { return p.ID == projectID })
+		if i < 0 {
+			c.JSON(404, gin.H{"error": "project not found"})
+			return
+		}
+		target := cfg.SLATarget
+		if validSLATarget(projects[i].SLATarget) {
+			target = projects[i].SLATarget
+		}
+		c.JSON(200, store.sla(projectID, window, target))
+	})
+
+	r.GET("/api/v1/timeline", apiRateLimit, requireAPIKey, func(c *gin.Context) {
+		projectID := strings.TrimSpace(c.Query("project_id"))
+		if projectID == "" {
+			c.JSON(400, gin.H{"error": "project_id is required"})
+			return
+		}
+		days := 90
+		if v := c.Query("days"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 366 {
+				c.JSON(400, gin.H{"error": "days must be between 1 and 366"})
+				return
+			}
+			days = n
+		}
+		loc := getCfg().DisplayTimezone
+		if loc == nil {
+			loc = time.UTC
+		}
+		c.JSON(200, gin.H{
+			"projectId": projectID,
+			"timezone":  loc.String(),
+			"days":      store.timeline(projectID, days, loc, time.Now()),
+		})
 	})
 
-	r.Run(":" + cfg.Port)
+	r.GET("/api/v1/incidents/stats", apiRateLimit, requireAPIKey, func(c *gin.Context) {
+		c.JSON(200, store.incidentStats(strings.TrimSpace(c.Query("project_id"))))
+	})
+
+	// The test and resend endpoints share one limiter so they can't be used
+	// to spam.
+	notifyTestLimit := func(c *gin.Context) {
+		limit := store.allowAction("notify-test:ip:"+c.ClientIP(), time.Minute, 3)
+		setRateLimitHeaders(c, limit)
+		if !limit.Allowed {
+			c.AbortWithStatusJSON(429, gin.H{"ok": false, "error": "too many requests"})
+		}
+	}
+
+	// Resends a stored incident, e.g. after fixing a webhook that was broken
+	// when it fired. Acknowledgment and MIN_NOTIFY_SEVERITY don't apply.
+	r.POST("/api/v1/incidents/:id/notify", requireAllowedIP, requireAdminKey, notifyTestLimit, func(c *gin.Context) {
+		incident, err := store.incidentByID(c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "incident not found"})
+			return
+		}
+		results := doWebhook(getCfg(), logger, incident)
+		if results == nil {
+			results = []DeliveryResult{}
+		}
+		ok := true
+		for _, r := range results {
+			ok = ok && r.OK
+		}
+		c.JSON(200, gin.H{"ok": ok, "results": results})
+	})
+
+	r.POST("/api/v1/notifications/test", requireAllowedIP, requireAdminKey, notifyTestLimit, func(c *gin.Context) {
+		results := doWebhook(getCfg(), logger, testIncident("TEST"))
+		if results == nil {
+			results = []DeliveryResult{}
+		}
+		ok := true
+		for _, r := range results {
+			ok = ok && r.OK
+		}
+		c.JSON(200, gin.H{"ok": ok, "results": results})
+	})
+
+	r.POST("/api/v1/webhooks/test", requireAllowedIP, requireAdminKey, notifyTestLimit, func(c *gin.Context) {
+		var req struct {
+			Status string `json:"status"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.BindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": "invalid json"})
+				return
+			}
+		}
+		status := strings.ToUpper(strings.TrimSpace(req.Status))
+		if status == "" {
+			status = "DOWN"
+		}
+		if statusRank(status) == 0 {
+			c.JSON(400, gin.H{"error": "status must be HEALTHY, SLOW, REDIRECT, DEGRADED or DOWN"})
+			return
+		}
+		// Sent synchronously so the response reports what each target said.
+		out := gin.H{}
+		for _, r := range doWebhook(getCfg(), logger, testIncident(status)) {
+			res := gin.H{"ok": r.OK}
+			if r.StatusCode != 0 {
+				res["status"] = r.StatusCode
+			}
+			if r.Error != "" {
+				res["error"] = r.Error
+			}
+			out[r.Channel] = res
+		}
+		c.JSON(200, out)
+	})
+
+	r.GET("/api/v1/mttr", apiRateLimit, requireAPIKey, func(c *gin.Context) {
+		projectID := strings.TrimSpace(c.Query("project_id"))
+		window, err := parseWindow(c.DefaultQuery("window", "30d"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		since := time.Now().Add(-window).UnixMilli()
+		c.JSON(200, gin.H{"projectId": projectID, "window": window.String(), "mttr": store.mttr(projectID, since)})
+	})
+
+	return r
 }
@@ -0,0 +1,1573 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testConfirmSecret = "test-confirm-secret"
+
+// newTestServer builds the API router over an in-memory store, with config
+// loaded from the environment like main does.
+func newTestServer(t *testing.T) (*gin.Engine, *Store) {
+	return newTestServerAt(t, t.TempDir()+"/confirm_store.json")
+}
+
+// newTestServerAt is newTestServer with the confirm store kept at path.
+func newTestServerAt(t *testing.T, path string) (*gin.Engine, *Store) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("CONFIRM_STORE_PATH", path)
+	cfg, store := newTestStore(t)
+	live := &liveConfig{cfg: &cfg}
+	r := newRouter(live.get, store, NewCircuitBreaker(), newPingTransport(false, 0), testLogger)
+	return r, store
+}
+
+var testLogger = slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+// newTestStore loads config from the environment over an in-memory store.
+// Pings are tried once so failing checks return quickly.
+func newTestStore(t testing.TB) (Config, *Store) {
+	t.Helper()
+	if os.Getenv("SUPABASE_URL") == "" {
+		t.Setenv("SUPABASE_URL", "http://supabase.invalid")
+	}
+	t.Setenv("SUPABASE_ANON_KEY", "test")
+	t.Setenv("STORE_BACKEND", "memory")
+	t.Setenv("CONFIRM_TOKEN_SECRET", testConfirmSecret)
+	t.Setenv("PING_RETRIES", "1")
+	if os.Getenv("CONFIRM_STORE_PATH") == "" {
+		t.Setenv("CONFIRM_STORE_PATH", t.TempDir()+"/confirm_store.json")
+	}
+	cfg, err := loadConfig("")
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	store, err := NewStore(cfg, testLogger)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	return cfg, store
+}
+
+// pingOnce runs one check of p and returns the result it recorded.
+func pingOnce(t *testing.T, p *Project, cfg Config, transport http.RoundTripper, store *Store) CheckResult {
+	t.Helper()
+	pingService(p, cfg, transport, store, testLogger)
+	h := store.getHistory(p.ID, 1, 0)
+	if len(h) != 1 {
+		t.Fatalf("got %d history entries for %s, want 1", len(h), p.ID)
+	}
+	return h[0]
+}
+
+func signTestToken(t *testing.T, p ConfirmTokenPayload) string {
+	t.Helper()
+	if p.Exp == 0 {
+		p.Exp = time.Now().Add(time.Hour).Unix()
+	}
+	token, err := signConfirmToken(testConfirmSecret, p)
+	if err != nil {
+		t.Fatalf("signConfirmToken: %v", err)
+	}
+	return token
+}
+
+func doJSON(r http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, rd)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestParseDotEnv(t *testing.T) {
+	t.Setenv("DOTENV_TEST_HOST", "db.internal")
+
+	cases := []struct {
+		name    string
+		content string
+		want    [][2]string
+	}{
+		{"plain", "A=1", [][2]string{{"A", "1"}}},
+		{"blank lines and comments", "\n# comment\n  \nA=1\n  # indented comment", [][2]string{{"A", "1"}}},
+		{"export prefix", "export A=1", [][2]string{{"A", "1"}}},
+		{"spaces around key and value", "  A =   1  ", [][2]string{{"A", "1"}}},
+		{"empty value", "A=", [][2]string{{"A", ""}}},
+		{"missing equals skipped", "JUSTAKEY\nA=1", [][2]string{{"A", "1"}}},
+		{"empty key skipped", "=1\nA=2", [][2]string{{"A", "2"}}},
+		{"equals in unquoted value", "URL=postgres://u:p@h/db?sslmode=disable", [][2]string{{"URL", "postgres://u:p@h/db?sslmode=disable"}}},
+		{"equals in double quotes", `A="x=y=z"`, [][2]string{{"A", "x=y=z"}}},
+		{"equals in single quotes", `A='x=y'`, [][2]string{{"A", "x=y"}}},
+		{"inline hash comment", "A=1 # note", [][2]string{{"A", "1"}}},
+		{"inline slash comment", "A=1 // note", [][2]string{{"A", "1"}}},
+		{"tab before comment", "A=1\t# note", [][2]string{{"A", "1"}}},
+		{"hash without space kept", "A=abc#def", [][2]string{{"A", "abc#def"}}},
+		{"url slashes kept", "A=https://example.com/x", [][2]string{{"A", "https://example.com/x"}}},
+		{"hash inside quotes kept", `A="x # y"`, [][2]string{{"A", "x # y"}}},
+		{"slashes inside quotes kept", `A='x // y'`, [][2]string{{"A", "x // y"}}},
+		{"double quote escapes", `A="a\nb\t\"c\"\\"`, [][2]string{{"A", "a\nb\t\"c\"\\"}}},
+		{"single quotes are literal", `A='a\n$B'`, [][2]string{{"A", `a\n$B`}}},
+		{"multiline double quotes", "A=\"line1\nline2\"\nB=2", [][2]string{{"A", "line1\nline2"}, {"B", "2"}}},
+		{"unterminated quote runs to end", "A=\"open\nrest", [][2]string{{"A", "open\nrest"}}},
+		{"backslash continuation", "A=one\\\n  two\\\nthree\nB=2", [][2]string{{"A", "onetwothree"}, {"B", "2"}}},
+		{"trailing backslash on last line", "A=one\\", [][2]string{{"A", "one\\"}}},
+		{"crlf line endings", "A=1\r\nB=2\r\n", [][2]string{{"A", "1"}, {"B", "2"}}},
+		{"expand from environment", "A=$DOTENV_TEST_HOST:5432", [][2]string{{"A", "db.internal:5432"}}},
+		{"expand braces from earlier line", "HOST=h\nURL=http://${HOST}/x", [][2]string{{"HOST", "h"}, {"URL", "http://h/x"}}},
+		{"expand in double quotes", "HOST=h\nA=\"$HOST\"", [][2]string{{"HOST", "h"}, {"A", "h"}}},
+		{"missing variable is empty", "A=x${DOTENV_TEST_MISSING}y", [][2]string{{"A", "xy"}}},
+		{"lone dollar kept", "A=cost $5", [][2]string{{"A", "cost $5"}}},
+		{"duplicate keys kept in order", "A=1\nA=2", [][2]string{{"A", "1"}, {"A", "2"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := parseDotEnv(tc.content)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("parseDotEnv(%q) = %q, want %q", tc.content, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestClassifyLatencyPerProjectThresholds(t *testing.T) {
+	cfg := Config{DegradedMs: 1200, SlowMs: 600}
+	strict := &Project{ID: "strict", DegradedMs: 300, SlowMs: 100}
+	lenient := &Project{ID: "lenient", DegradedMs: 5000, SlowMs: 2000}
+	defaults := &Project{ID: "defaults"}
+
+	cases := []struct {
+		latencyMs int64
+		p         *Project
+		want      string
+	}{
+		{250, strict, "SLOW"},
+		{250, lenient, "HEALTHY"},
+		{250, defaults, "HEALTHY"},
+		{800, strict, "DEGRADED"},
+		{800, lenient, "HEALTHY"},
+		{800, defaults, "SLOW"},
+		{3000, strict, "DEGRADED"},
+		{3000, lenient, "SLOW"},
+		{3000, defaults, "DEGRADED"},
+	}
+	for _, tc := range cases {
+		if got := classifyLatency(tc.latencyMs, tc.p, cfg); got != tc.want {
+			t.Errorf("classifyLatency(%d, %s) = %s, want %s", tc.latencyMs, tc.p.ID, got, tc.want)
+		}
+	}
+}
+
+func TestClassifyLatencyBoundaries(t *testing.T) {
+	cases := []struct {
+		name      string
+		latencyMs int64
+		cfg       Config
+		want      string
+	}{
+		{"below slow", 599, Config{DegradedMs: 1200, SlowMs: 600}, "HEALTHY"},
+		{"equal to slow", 600, Config{DegradedMs: 1200, SlowMs: 600}, "SLOW"},
+		{"below degraded", 1199, Config{DegradedMs: 1200, SlowMs: 600}, "SLOW"},
+		{"equal to degraded", 1200, Config{DegradedMs: 1200, SlowMs: 600}, "DEGRADED"},
+		{"slow disabled below degraded", 1199, Config{DegradedMs: 1200}, "HEALTHY"},
+		{"slow disabled equal to degraded", 1200, Config{DegradedMs: 1200}, "DEGRADED"},
+		{"zero latency", 0, Config{DegradedMs: 1200, SlowMs: 600}, "HEALTHY"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyLatency(tc.latencyMs, &Project{}, tc.cfg); got != tc.want {
+				t.Errorf("classifyLatency(%d) = %s, want %s", tc.latencyMs, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfirmationRateLimitHeaders(t *testing.T) {
+	r, _ := newTestServer(t)
+	body := `{"email":"limits@example.com"}`
+	now := time.Now().Unix()
+
+	for i := 1; i <= 5; i++ {
+		w := doJSON(r, "POST", "/api/v1/auth/send-confirmation", body)
+		if w.Code != 200 {
+			t.Fatalf("request %d: status %d, body %s", i, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-RateLimit-Limit"); got != "5" {
+			t.Errorf("request %d: X-RateLimit-Limit = %q, want 5", i, got)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != strconv.Itoa(5-i) {
+			t.Errorf("request %d: X-RateLimit-Remaining = %q, want %d", i, got, 5-i)
+		}
+		reset, err := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil || reset < now || reset > now+601 {
+			t.Errorf("request %d: X-RateLimit-Reset = %q, want a unix time within the 10m window", i, w.Header().Get("X-RateLimit-Reset"))
+		}
+		if w.Header().Get("Retry-After") != "" {
+			t.Errorf("request %d: unexpected Retry-After on an allowed request", i)
+		}
+	}
+
+	w := doJSON(r, "POST", "/api/v1/auth/send-confirmation", body)
+	if w.Code != 429 {
+		t.Fatalf("6th request: status %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("X-RateLimit-Limit"); got != "5" {
+		t.Errorf("rejected: X-RateLimit-Limit = %q, want 5", got)
+	}
+	if got := w.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("rejected: X-RateLimit-Remaining = %q, want 0", got)
+	}
+	if w.Header().Get("X-RateLimit-Reset") == "" || w.Header().Get("Retry-After") == "" {
+		t.Errorf("rejected: missing X-RateLimit-Reset or Retry-After: %v", w.Header())
+	}
+}
+
+func TestUnsubscribeRateLimitHeadersPerIP(t *testing.T) {
+	r, store := newTestServer(t)
+	// The per-IP bucket (10/min) trips first when every request asks for a
+	// different address.
+	for i := 0; i < 11; i++ {
+		email := "ip" + strconv.Itoa(i) + "@example.com"
+		store.confirmWithNonce(email, "nonce-"+email, time.Now().Add(time.Hour).Unix())
+		w := doJSON(r, "GET", "/api/v1/auth/send-unsubscribe?email="+email, "")
+		want := 200
+		if i == 10 {
+			want = 429
+		}
+		if w.Code != want {
+			t.Fatalf("request %d: status %d, want %d", i+1, w.Code, want)
+		}
+		if w.Header().Get("X-RateLimit-Limit") == "" || w.Header().Get("X-RateLimit-Remaining") == "" || w.Header().Get("X-RateLimit-Reset") == "" {
+			t.Errorf("request %d: missing X-RateLimit-* headers: %v", i+1, w.Header())
+		}
+		if i == 10 {
+			var resp map[string]any
+			_ = json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp["error"] != "too many requests" {
+				t.Errorf("rejected body = %s", w.Body)
+			}
+			if got := w.Header().Get("X-RateLimit-Limit"); got != "10" {
+				t.Errorf("rejected: X-RateLimit-Limit = %q, want 10", got)
+			}
+		}
+	}
+}
+
+func TestConfirmTokenReuseRejected(t *testing.T) {
+	r, store := newTestServer(t)
+	token := signTestToken(t, ConfirmTokenPayload{Email: "once@example.com", Nonce: "confirm-nonce"})
+	target := "/api/v1/auth/confirm?token=" + url.QueryEscape(token)
+
+	if w := doJSON(r, "GET", target, ""); w.Code != 200 {
+		t.Fatalf("first confirm: status %d, body %s", w.Code, w.Body)
+	}
+	if !store.isConfirmed("once@example.com") {
+		t.Fatal("email not confirmed after first use")
+	}
+	w := doJSON(r, "GET", target, "")
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "token already used") {
+		t.Fatalf("second confirm: status %d, body %s; want 400 token already used", w.Code, w.Body)
+	}
+}
+
+func TestUnsubscribeTokenReuseRejected(t *testing.T) {
+	r, store := newTestServer(t)
+	store.confirmWithNonce("leaving@example.com", "confirm-nonce", time.Now().Add(time.Hour).Unix())
+	token := signTestToken(t, ConfirmTokenPayload{Email: "leaving@example.com", Nonce: "unsub-nonce", Action: "unsubscribe"})
+	body := `{"email":"leaving@example.com","token":"` + token + `"}`
+
+	w := doJSON(r, "POST", "/api/v1/auth/unsubscribe", body)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"unsubscribed":true`) {
+		t.Fatalf("first unsubscribe: status %d, body %s", w.Code, w.Body)
+	}
+	// Confirming again must not let the old unsubscribe link be replayed.
+	store.confirmWithNonce("leaving@example.com", "confirm-nonce-2", time.Now().Add(time.Hour).Unix())
+	w = doJSON(r, "POST", "/api/v1/auth/unsubscribe", body)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "token already used") {
+		t.Fatalf("second unsubscribe: status %d, body %s; want 400 token already used", w.Code, w.Body)
+	}
+	if !store.isConfirmed("leaving@example.com") {
+		t.Error("replayed unsubscribe removed the new confirmation")
+	}
+}
+
+func TestConsumedNoncesSurviveRestart(t *testing.T) {
+	r, _ := newTestServer(t)
+	token := signTestToken(t, ConfirmTokenPayload{Email: "persist@example.com", Nonce: "persisted-nonce"})
+	target := "/api/v1/auth/confirm?token=" + url.QueryEscape(token)
+	if w := doJSON(r, "GET", target, ""); w.Code != 200 {
+		t.Fatalf("first confirm: status %d, body %s", w.Code, w.Body)
+	}
+
+	// Unsubscribe and revoke consume nonces without confirming anything, and
+	// revoke of an address that isn't confirmed changes nothing else at all.
+	unsubscribe := `{"email":"persist@example.com","token":"` +
+		signTestToken(t, ConfirmTokenPayload{Email: "persist@example.com", Nonce: "unsub-nonce", Action: "unsubscribe"}) + `"}`
+	if w := doJSON(r, "POST", "/api/v1/auth/unsubscribe", unsubscribe); w.Code != 200 {
+		t.Fatalf("unsubscribe: status %d, body %s", w.Code, w.Body)
+	}
+	revoke := `{"token":"` + signTestToken(t, ConfirmTokenPayload{Email: "never@example.com", Nonce: "revoke-nonce"}) + `"}`
+	if w := doJSON(r, "POST", "/api/v1/auth/revoke", revoke); w.Code != 200 {
+		t.Fatalf("revoke: status %d, body %s", w.Code, w.Body)
+	}
+
+	// A fresh store over the same CONFIRM_STORE_PATH stands in for a restart.
+	restarted, _ := newTestServerAt(t, os.Getenv("CONFIRM_STORE_PATH"))
+	for _, replay := range []struct{ method, target, body string }{
+		{"GET", target, ""},
+		{"POST", "/api/v1/auth/unsubscribe", unsubscribe},
+		{"POST", "/api/v1/auth/revoke", revoke},
+	} {
+		w := doJSON(restarted, replay.method, replay.target, replay.body)
+		if w.Code != 400 || !strings.Contains(w.Body.String(), "token already used") {
+			t.Errorf("%s after restart: status %d, body %s; want 400 token already used", replay.target, w.Code, w.Body)
+		}
+	}
+}
+
+func TestDownsampleBucketBoundaries(t *testing.T) {
+	const minute = int64(time.Minute / time.Millisecond)
+	const base = int64(1_700_000_040_000) // a whole minute
+	up := func(ts, latency int64) CheckResult {
+		return CheckResult{TS: ts, Status: "HEALTHY", LatencyMs: latency, Code: 200}
+	}
+
+	cases := []struct {
+		name    string
+		results []CheckResult
+		want    []CheckResult
+	}{
+		{"empty", nil, nil},
+		{
+			"sample exactly at bucket start",
+			[]CheckResult{up(base, 100)},
+			[]CheckResult{{TS: base, Status: "HEALTHY", LatencyMs: 100, Code: 200, Samples: 1}},
+		},
+		{
+			"last millisecond stays in bucket",
+			[]CheckResult{up(base, 100), up(base+minute-1, 300)},
+			[]CheckResult{{TS: base, Status: "HEALTHY", LatencyMs: 200, Code: 200, Samples: 2}},
+		},
+		{
+			"next bucket starts at width",
+			[]CheckResult{up(base+minute-1, 100), up(base+minute, 300)},
+			[]CheckResult{
+				{TS: base, Status: "HEALTHY", LatencyMs: 100, Code: 200, Samples: 1},
+				{TS: base + minute, Status: "HEALTHY", LatencyMs: 300, Code: 200, Samples: 1},
+			},
+		},
+		{
+			"empty buckets are not synthesized",
+			[]CheckResult{up(base, 100), up(base+3*minute+5, 300)},
+			[]CheckResult{
+				{TS: base, Status: "HEALTHY", LatencyMs: 100, Code: 200, Samples: 1},
+				{TS: base + 3*minute, Status: "HEALTHY", LatencyMs: 300, Code: 200, Samples: 1},
+			},
+		},
+		{
+			"worst status and its error win",
+			[]CheckResult{
+				up(base+1, 100),
+				{TS: base + 2, Status: "DOWN", Code: 503, Error: "boom", ErrorCategory: "HTTP_5XX"},
+				{TS: base + 3, Status: "DEGRADED", LatencyMs: 2000, Code: 200},
+			},
+			[]CheckResult{{TS: base, Status: "DOWN", LatencyMs: 1050, Code: 503, Error: "boom", ErrorCategory: "HTTP_5XX", Samples: 3}},
+		},
+		{
+			"all down has no latency",
+			[]CheckResult{{TS: base + 10, Status: "DOWN", LatencyMs: 5000}},
+			[]CheckResult{{TS: base, Status: "DOWN", Samples: 1}},
+		},
+		{
+			"negative timestamps align to the epoch",
+			[]CheckResult{up(-1, 100), up(0, 200)},
+			[]CheckResult{
+				{TS: -minute, Status: "HEALTHY", LatencyMs: 100, Code: 200, Samples: 1},
+				{TS: 0, Status: "HEALTHY", LatencyMs: 200, Code: 200, Samples: 1},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := downsample(tc.results, time.Minute)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("downsample() =\n%+v\nwant\n%+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPingBasicAuth(t *testing.T) {
+	cfg, store := newTestStore(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "monitor" || pass != "s3cret-pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(401)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	ok := &Project{ID: "basic-ok", URL: srv.URL, Credentials: &Credentials{Type: "basic", Username: "monitor", Password: "s3cret-pass"}}
+	if got := pingOnce(t, ok, cfg, http.DefaultTransport, store); got.Status != "HEALTHY" || got.Code != 200 {
+		t.Errorf("with credentials: status %s code %d, want HEALTHY 200", got.Status, got.Code)
+	}
+	wrong := &Project{ID: "basic-wrong", URL: srv.URL, Credentials: &Credentials{Type: "basic", Username: "monitor", Password: "nope"}}
+	if got := pingOnce(t, wrong, cfg, http.DefaultTransport, store); got.Status != "DOWN" || got.Code != 401 {
+		t.Errorf("wrong password: status %s code %d, want DOWN 401", got.Status, got.Code)
+	}
+	none := &Project{ID: "basic-none", URL: srv.URL}
+	if got := pingOnce(t, none, cfg, http.DefaultTransport, store); got.Status != "DOWN" || got.Code != 401 {
+		t.Errorf("no credentials: status %s code %d, want DOWN 401", got.Status, got.Code)
+	}
+}
+
+func TestPingCredentialsRedactedFromError(t *testing.T) {
+	cfg, store := newTestStore(t)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	deadURL := closed.URL
+	closed.Close()
+	// Redirect to a closed port with the credentials in the query, so the
+	// transport error quotes the secrets back.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, cred, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		leak := "?cred=" + cred
+		if _, pass, ok := r.BasicAuth(); ok {
+			leak += "&pass=" + pass
+		}
+		http.Redirect(w, r, deadURL+"/"+leak, http.StatusFound)
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		creds   *Credentials
+		secrets []string
+	}{
+		{&Credentials{Type: "bearer", Token: "bearer-t0ken"}, []string{"bearer-t0ken"}},
+		{&Credentials{Type: "basic", Username: "monitor", Password: "s3cret-pass"}, []string{"s3cret-pass", "bW9uaXRvcjpzM2NyZXQtcGFzcw=="}},
+	}
+	for _, tc := range cases {
+		p := &Project{ID: "redact-" + tc.creds.Type, URL: srv.URL, Credentials: tc.creds}
+		got := pingOnce(t, p, cfg, http.DefaultTransport, store)
+		if got.Status != "DOWN" || got.Error == "" {
+			t.Fatalf("%s: status %s error %q, want DOWN with an error", tc.creds.Type, got.Status, got.Error)
+		}
+		for _, secret := range tc.secrets {
+			if strings.Contains(got.Error, secret) {
+				t.Errorf("%s: error leaks %q: %s", tc.creds.Type, secret, got.Error)
+			}
+		}
+		if !strings.Contains(got.Error, "[REDACTED]") {
+			t.Errorf("%s: error %q has no redaction marker", tc.creds.Type, got.Error)
+		}
+	}
+}
+
+func TestPingUserAgent(t *testing.T) {
+	seen := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Get("User-Agent")
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		name    string
+		envUA   string
+		headers PingHeaders
+		want    string
+	}{
+		{"default", "", nil, "heartbeat/1.0"},
+		{"configured", "acme-probe/2.3", nil, "acme-probe/2.3"},
+		{"project override", "acme-probe/2.3", PingHeaders{"user-agent": "payments-check"}, "payments-check"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("PING_USER_AGENT", tc.envUA)
+			cfg, store := newTestStore(t)
+			p := &Project{ID: "ua", URL: srv.URL, Headers: tc.headers}
+			pingOnce(t, p, cfg, http.DefaultTransport, store)
+			if got := <-seen; got != tc.want {
+				t.Errorf("User-Agent = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPingForceHTTP2(t *testing.T) {
+	cfg, store := newTestStore(t)
+	protos := make(chan string, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.Proto
+	})
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{MinVersion: tls.VersionTLS13}
+	srv.StartTLS()
+	defer srv.Close()
+
+	transport := newPingTransport(true, tls.VersionTLS13)
+	transport.TLSClientConfig.RootCAs = srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	p := &Project{ID: "h2", URL: srv.URL}
+	got := pingOnce(t, p, cfg, transport, store)
+	if got.Status != "HEALTHY" {
+		t.Fatalf("status %s (%s), want HEALTHY", got.Status, got.Error)
+	}
+	if proto := <-protos; proto != "HTTP/2.0" {
+		t.Errorf("server saw %s, want HTTP/2.0", proto)
+	}
+	if got.TLSVersion != "TLS 1.3" {
+		t.Errorf("TLSVersion = %q, want TLS 1.3", got.TLSVersion)
+	}
+
+	// A server without h2 fails the check rather than falling back.
+	h1 := httptest.NewTLSServer(handler)
+	defer h1.Close()
+	transport.TLSClientConfig.RootCAs = h1.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	p = &Project{ID: "h1-only", URL: h1.URL}
+	if got := pingOnce(t, p, cfg, transport, store); got.Status != "DOWN" {
+		t.Errorf("HTTP/1.1-only server: status %s, want DOWN", got.Status)
+	}
+}
+
+func TestIncidentStats(t *testing.T) {
+	ptr := func(v int64) *int64 { return &v }
+	const t0 = int64(1_700_000_000_000)
+	incidents := []Incident{
+		{ProjectID: "api", Status: "DOWN", OpenedAt: t0, ResolvedAt: t0 + 60_000},
+		{ProjectID: "api", Status: "DEGRADED", OpenedAt: t0 + 3_600_000, ResolvedAt: t0 + 3_780_000},
+		{ProjectID: "api", Status: "DOWN", OpenedAt: t0 + 7_200_000},
+		{ProjectID: "web", Status: "DEGRADED", OpenedAt: t0 + 1_000},
+		{ProjectID: "cdn", Status: "DOWN", OpenedAt: t0 + 5_000, ResolvedAt: t0 + 35_000},
+	}
+
+	cases := []struct {
+		projectID string
+		want      IncidentStats
+	}{
+		{"api", IncidentStats{
+			ProjectID: "api", TotalIncidents: 3, DownIncidents: 2, DegradedIncidents: 1,
+			// Openings 1h apart; the open incident doesn't count towards MTTR.
+			MeanTimeBetweenIncidentsMs: ptr(3_600_000),
+			MeanTimeToRecoveryMs:       ptr(120_000),
+		}},
+		// A single open incident gives neither mean.
+		{"web", IncidentStats{ProjectID: "web", TotalIncidents: 1, DegradedIncidents: 1}},
+		{"cdn", IncidentStats{ProjectID: "cdn", TotalIncidents: 1, DownIncidents: 1, MeanTimeToRecoveryMs: ptr(30_000)}},
+		{"none", IncidentStats{ProjectID: "none"}},
+		{"", IncidentStats{
+			TotalIncidents: 5, DownIncidents: 3, DegradedIncidents: 2,
+			MeanTimeBetweenIncidentsMs: ptr(1_800_000),
+			MeanTimeToRecoveryMs:       ptr(90_000),
+		}},
+	}
+	_, store := newTestStore(t)
+	store.incidents = incidents
+	for _, tc := range cases {
+		got := store.incidentStats(tc.projectID)
+		if !reflect.DeepEqual(got, tc.want) {
+			gj, _ := json.Marshal(got)
+			wj, _ := json.Marshal(tc.want)
+			t.Errorf("incidentStats(%q) = %s, want %s", tc.projectID, gj, wj)
+		}
+	}
+}
+
+func TestProjectsQuery(t *testing.T) {
+	cases := []struct {
+		tag  string
+		want string
+	}{
+		{"", "select=*"},
+		{"payments", `select=*&tags=cs.%7B%22payments%22%7D`},
+		{"team a,b", `select=*&tags=cs.%7B%22team+a%2Cb%22%7D`},
+		{`say "hi"`, `select=*&tags=cs.%7B%22say+%5C%22hi%5C%22%22%7D`},
+	}
+	for _, tc := range cases {
+		if got := projectsQuery(tc.tag); got != tc.want {
+			t.Errorf("projectsQuery(%q) = %s, want %s", tc.tag, got, tc.want)
+		}
+	}
+}
+
+func TestFetchProjectsTagFilter(t *testing.T) {
+	cfg, _ := newTestStore(t)
+	var gotQuery url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/v1/projects" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		gotQuery = r.URL.Query()
+		w.Write([]byte(`[{"id":"p1","url":"https://pay.example.com","tags":["payments"]}]`))
+	}))
+	defer srv.Close()
+	cfg.SupabaseURL = srv.URL
+
+	projects, err := fetchProjects(cfg, "payments", testLogger)
+	if err != nil || len(projects) != 1 {
+		t.Fatalf("fetchProjects: %v, %d projects", err, len(projects))
+	}
+	if got := gotQuery.Get("tags"); got != `cs.{"payments"}` {
+		t.Errorf("tags filter = %q, want cs.{\"payments\"}", got)
+	}
+	if got := gotQuery.Get("select"); got != "*" {
+		t.Errorf("select = %q, want *", got)
+	}
+
+	if _, err := fetchProjects(cfg, "", testLogger); err != nil {
+		t.Fatalf("fetchProjects untagged: %v", err)
+	}
+	if gotQuery.Has("tags") {
+		t.Errorf("untagged fetch sent a tags filter: %v", gotQuery)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "user@example.com", want: "user@example.com"},
+		{in: "  user@example.com  ", want: "user@example.com"},
+		{in: "user+alerts@example.com", want: "user+alerts@example.com"},
+		{in: "first.last@sub.example.co.uk", want: "first.last@sub.example.co.uk"},
+		{in: "User@EXAMPLE.Com", want: "User@example.com"},
+		{in: "user@example.com.", want: "user@example.com"},
+		{in: "user@bücher.de", want: "user@bücher.de"},
+		{in: "user@BÜCHER.de", want: "user@bücher.de"},
+		{in: "user@xn--bcher-kva.de", want: "user@xn--bcher-kva.de"},
+		{in: "o'brien@example.com", want: "o'brien@example.com"},
+		{in: "a@", wantErr: true},
+		{in: "@b.com", wantErr: true},
+		{in: "user", wantErr: true},
+		{in: "user@localhost", wantErr: true},
+		{in: "user@example..com", wantErr: true},
+		{in: "user@-example.com", wantErr: true},
+		{in: "user@example-.com", wantErr: true},
+		{in: "user.@example.com", wantErr: true},
+		{in: "us er@example.com", wantErr: true},
+		{in: "Name <user@example.com>", wantErr: true},
+		{in: "a@b@example.com", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := normalizeEmail(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("normalizeEmail(%q) = %q, want an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("normalizeEmail(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestSendConfirmationRejectsMalformedEmail(t *testing.T) {
+	r, _ := newTestServer(t)
+	for _, email := range []string{"a@", "@b", "user@localhost"} {
+		w := doJSON(r, "POST", "/api/v1/auth/send-confirmation", `{"email":"`+email+`"}`)
+		if w.Code != 400 {
+			t.Errorf("%q: status %d, want 400", email, w.Code)
+		}
+		// Rejected before any rate-limit slot is taken.
+		if w.Header().Get("X-RateLimit-Remaining") != "" {
+			t.Errorf("%q: rate limit consumed: %v", email, w.Header())
+		}
+	}
+}
+
+func TestIPAllowlist(t *testing.T) {
+	t.Setenv("IP_ALLOWLIST", "10.0.0.0/8, 192.168.1.0/24, 2001:db8::/32, ::1/128")
+	r, _ := newTestServer(t)
+
+	cases := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"10.1.2.3:5000", 200},
+		{"192.168.1.254:5000", 200},
+		{"192.168.2.1:5000", 403},
+		{"8.8.8.8:5000", 403},
+		{"[2001:db8::1]:5000", 200},
+		{"[2001:db8:ffff::abcd]:5000", 200},
+		{"[2001:db9::1]:5000", 403},
+		{"[::1]:5000", 200},
+		{"[::2]:5000", 403},
+		// IPv4-mapped IPv6 matches the IPv4 block.
+		{"[::ffff:10.0.0.1]:5000", 200},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/api/v1/auth/is-confirmed?email=a@example.com", nil)
+		req.RemoteAddr = tc.remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d", tc.remoteAddr, w.Code, tc.want)
+		}
+	}
+}
+
+func TestIPAllowlistIgnoresSpoofedForwardedFor(t *testing.T) {
+	t.Setenv("IP_ALLOWLIST", "10.0.0.0/8")
+	r, _ := newTestServer(t)
+	req := httptest.NewRequest("GET", "/api/v1/auth/is-confirmed?email=a@example.com", nil)
+	req.RemoteAddr = "8.8.8.8:5000"
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Errorf("spoofed X-Forwarded-For: status %d, want 403", w.Code)
+	}
+}
+
+func TestIPAllowlistTrustedProxy(t *testing.T) {
+	t.Setenv("IP_ALLOWLIST", "10.0.0.0/8")
+	t.Setenv("TRUSTED_PROXIES", "192.168.0.0/16")
+	r, _ := newTestServer(t)
+	cases := []struct {
+		remoteAddr string
+		want       int
+	}{
+		{"192.168.1.1:5000", 200},
+		{"8.8.8.8:5000", 403},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", "/api/v1/auth/is-confirmed?email=a@example.com", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("via %s: status %d, want %d", tc.remoteAddr, w.Code, tc.want)
+		}
+	}
+}
+
+func TestIPAllowlistEmptyAllowsAll(t *testing.T) {
+	t.Setenv("IP_ALLOWLIST", "")
+	r, _ := newTestServer(t)
+	for _, addr := range []string{"8.8.8.8:5000", "[2001:db9::1]:5000"} {
+		req := httptest.NewRequest("GET", "/api/v1/auth/is-confirmed?email=a@example.com", nil)
+		req.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Errorf("%s: status %d, want 200", addr, w.Code)
+		}
+	}
+}
+
+func TestIPAllowlistInvalidEntry(t *testing.T) {
+	t.Setenv("SUPABASE_URL", "http://supabase.invalid")
+	t.Setenv("SUPABASE_ANON_KEY", "test")
+	t.Setenv("STORE_BACKEND", "memory")
+	for _, entry := range []string{"10.0.0.1", "10.0.0.0/33", "2001:db8::/129", "office"} {
+		t.Setenv("IP_ALLOWLIST", entry)
+		if _, err := loadConfig(""); err == nil {
+			t.Errorf("IP_ALLOWLIST=%q: loadConfig succeeded, want an error", entry)
+		}
+	}
+	t.Setenv("IP_ALLOWLIST", "")
+	t.Setenv("TRUSTED_PROXIES", "proxy.internal")
+	if _, err := loadConfig(""); err == nil {
+		t.Error("TRUSTED_PROXIES=proxy.internal: loadConfig succeeded, want an error")
+	}
+}
+
+// benchmarkRateLimitMemory fills 10k keys with 100 actions each and reports
+// the heap retained by the limiter's state.
+func benchmarkRateLimitMemory(b *testing.B, algo string) {
+	const keys, perKey = 10_000, 100
+	b.Setenv("RATE_LIMIT_ALGO", algo)
+	b.Setenv("RATE_LIMIT_SWEEP_SECONDS", "0")
+	for i := 0; i < b.N; i++ {
+		_, store := newTestStore(b)
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		for k := 0; k < keys; k++ {
+			key := "bench:" + strconv.Itoa(k)
+			for j := 0; j < perKey; j++ {
+				store.allowAction(key, time.Hour, perKey)
+			}
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/keys, "heap-B/key")
+		runtime.KeepAlive(store)
+	}
+}
+
+func BenchmarkRateLimitMemorySliding(b *testing.B) {
+	benchmarkRateLimitMemory(b, "sliding")
+}
+
+func BenchmarkRateLimitMemoryTokenBucket(b *testing.B) {
+	benchmarkRateLimitMemory(b, "token_bucket")
+}
+
+func benchmarkAllowAction(b *testing.B, algo string) {
+	b.Setenv("RATE_LIMIT_ALGO", algo)
+	_, store := newTestStore(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.allowAction("bench:"+strconv.Itoa(i%10_000), time.Hour, 100)
+	}
+}
+
+func BenchmarkAllowActionSliding(b *testing.B) {
+	benchmarkAllowAction(b, "sliding")
+}
+
+func BenchmarkAllowActionTokenBucket(b *testing.B) {
+	benchmarkAllowAction(b, "token_bucket")
+}
+
+func TestStatusReturnsBareArray(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+	t.Setenv("SUPABASE_URL", srv.URL)
+	r, _ := newTestServer(t)
+
+	w := doJSON(r, "GET", "/api/v1/status", "")
+	if w.Code != 200 {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	var projects []Project
+	if err := json.Unmarshal(w.Body.Bytes(), &projects); err != nil {
+		t.Errorf("body is not a JSON array: %s", w.Body)
+	}
+	if _, err := strconv.ParseInt(w.Header().Get("X-Supabase-Latency-Ms"), 10, 64); err != nil {
+		t.Errorf("X-Supabase-Latency-Ms = %q, want an integer", w.Header().Get("X-Supabase-Latency-Ms"))
+	}
+}
+
+func TestTrackIsolationUsesAllEnabledProjects(t *testing.T) {
+	_, store := newTestStore(t)
+	disabled := false
+	store.projects.projects = []Project{
+		{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d"},
+		{ID: "off", Enabled: &disabled},
+		{ID: "new"}, // not checked yet
+	}
+	set := func(statuses map[string]string) {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		maps.Copy(store.lastStatusByID, statuses)
+	}
+
+	// One project down out of four: not isolated, whatever batch just ran.
+	set(map[string]string{"a": "DOWN", "b": "HEALTHY", "c": "HEALTHY", "d": "HEALTHY", "off": "DOWN"})
+	if inc, isolated := store.trackIsolation(0.75); inc != nil || isolated {
+		t.Fatalf("1/4 down: incident %v, isolated %v", inc, isolated)
+	}
+
+	// The scheduler's latest batch may be a single project, but three of the
+	// four enabled projects are now down. The disabled one doesn't count.
+	set(map[string]string{"b": "DOWN", "c": "DOWN"})
+	inc, isolated := store.trackIsolation(0.75)
+	if inc == nil || !isolated || inc.Status != "ISOLATED" {
+		t.Fatalf("3/4 down: incident %v, isolated %v; want an ISOLATED incident", inc, isolated)
+	}
+	if !strings.Contains(inc.Message, "3/4") {
+		t.Errorf("message %q should count 3/4 projects", inc.Message)
+	}
+	if inc, isolated := store.trackIsolation(0.75); inc != nil || !isolated {
+		t.Errorf("still isolated: incident %v, isolated %v; want no new incident", inc, isolated)
+	}
+
+	set(map[string]string{"b": "HEALTHY"})
+	inc, isolated = store.trackIsolation(0.75)
+	if inc == nil || isolated || inc.ResolvedAt == 0 {
+		t.Fatalf("2/4 down: incident %v, isolated %v; want a resolving incident", inc, isolated)
+	}
+}
+
+func TestHistoryCSVRoutes(t *testing.T) {
+	r, store := newTestServer(t)
+	const t0 = int64(1_700_000_000_000)
+	store.mu.Lock()
+	store.historyByID["p1"] = []CheckResult{
+		{TS: t0, Status: "HEALTHY", LatencyMs: 120, Code: 200},
+		{TS: t0 + 60_000, Status: "DOWN", Code: 503, Error: `upstream said "no", retry later`},
+		{TS: t0 + 120_000, Status: "SLOW", LatencyMs: 900, Code: 200},
+	}
+	store.mu.Unlock()
+
+	readCSV := func(target string) [][]string {
+		t.Helper()
+		w := doJSON(r, "GET", target, "")
+		if w.Code != 200 {
+			t.Fatalf("%s: status %d, body %s", target, w.Code, w.Body)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+			t.Errorf("%s: Content-Type %q", target, ct)
+		}
+		rows, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		return rows
+	}
+
+	all := readCSV("/api/v1/history/export?project_id=p1")
+	if want := []string{"timestamp_ms", "status", "latency_ms", "http_code", "error"}; len(all) != 4 || !reflect.DeepEqual(all[0], want) {
+		t.Fatalf("export = %q, want header %q plus 3 rows", all, want)
+	}
+	if want := []string{"1700000060000", "DOWN", "0", "503", `upstream said "no", retry later`}; !reflect.DeepEqual(all[2], want) {
+		t.Errorf("export row = %q, want %q", all[2], want)
+	}
+	viaHistory := readCSV("/api/v1/history?project_id=p1&format=csv")
+	if want := []string{"ts", "ts_iso", "status", "latency", "code", "error"}; len(viaHistory) != 4 || !reflect.DeepEqual(viaHistory[0], want) {
+		t.Fatalf("format=csv = %q, want header %q plus 3 rows", viaHistory, want)
+	}
+	if want := []string{"1700000060000", "2023-11-14T22:14:20Z", "DOWN", "0", "503", `upstream said "no", retry later`}; !reflect.DeepEqual(viaHistory[2], want) {
+		t.Errorf("format=csv row = %q, want %q", viaHistory[2], want)
+	}
+
+	for _, target := range []string{
+		"/api/v1/history/export?project_id=p1&start_ts=1700000060000&end_ts=1700000120000",
+		"/api/v1/history?project_id=p1&format=csv&start_ts=1700000060000&end_ts=1700000120000",
+	} {
+		rows := readCSV(target)
+		if len(rows) != 3 || rows[1][0] != "1700000060000" || rows[2][0] != "1700000120000" {
+			t.Errorf("%s = %q, want the last two checks", target, rows)
+		}
+	}
+	if rows := readCSV("/api/v1/history/export?project_id=p1&end_ts=1700000000000"); len(rows) != 2 {
+		t.Errorf("end_ts bound is inclusive: got %q", rows)
+	}
+	if w := doJSON(r, "GET", "/api/v1/history/export?project_id=p1&start_ts=abc", ""); w.Code != 400 {
+		t.Errorf("bad start_ts: status %d, want 400", w.Code)
+	}
+}
+
+func TestConfigFileEscalationIntervalMinutes(t *testing.T) {
+	t.Setenv("SUPABASE_URL", "http://supabase.invalid")
+	t.Setenv("SUPABASE_ANON_KEY", "test")
+	t.Setenv("STORE_BACKEND", "memory")
+	// The file only fills variables the environment leaves unset; t.Setenv
+	// restores whatever was there afterwards.
+	t.Setenv("ESCALATION_INTERVAL_MINUTES", "")
+	os.Unsetenv("ESCALATION_INTERVAL_MINUTES")
+	path := t.TempDir() + "/config.yaml"
+	if err := os.WriteFile(path, []byte("escalation_interval_minutes: 30\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.EscalationInterval != 30*time.Minute {
+		t.Errorf("EscalationInterval = %v, want 30m", cfg.EscalationInterval)
+	}
+}
+
+func TestSLACoverage(t *testing.T) {
+	_, store := newTestStore(t)
+	now := time.Now()
+	checksSince := func(start time.Time, n int, downEvery int) []CheckResult {
+		var out []CheckResult
+		step := now.Sub(start) / time.Duration(n)
+		for i := 0; i < n; i++ {
+			status := "HEALTHY"
+			if downEvery > 0 && i%downEvery == 0 {
+				status = "DOWN"
+			}
+			out = append(out, CheckResult{TS: start.Add(time.Duration(i) * step).UnixMilli(), Status: status})
+		}
+		return out
+	}
+	store.mu.Lock()
+	store.historyByID["full"] = checksSince(now.Add(-48*time.Hour), 480, 0)
+	store.historyByID["recent"] = checksSince(now.Add(-6*time.Hour), 60, 0)
+	store.historyByID["flaky"] = checksSince(now.Add(-48*time.Hour), 480, 10)
+	store.mu.Unlock()
+
+	full := store.sla("full", 24*time.Hour, 99.9)
+	if full.Status != "met" || full.AllowedDowntimeMinutes == nil || full.Covered != "24h0m0s" {
+		t.Errorf("full coverage: status %q covered %q budget %v", full.Status, full.Covered, full.AllowedDowntimeMinutes)
+	}
+
+	// Six hours of history can't vouch for a 24h window.
+	recent := store.sla("recent", 24*time.Hour, 99.9)
+	if recent.Status != "insufficient data" {
+		t.Errorf("short history: status %q, want insufficient data", recent.Status)
+	}
+	if recent.Uptime == nil || *recent.Uptime != 100 {
+		t.Errorf("short history: uptime %v, want 100 over the covered span", recent.Uptime)
+	}
+	if recent.AllowedDowntimeMinutes != nil || recent.ErrorBudgetConsumed != nil || recent.RemainingDowntimeMinutes != nil {
+		t.Errorf("short history: budget fields set: %+v", recent)
+	}
+	if recent.Covered != "6h0m0s" || recent.CoveredFrom != store.historyByID["recent"][0].TS {
+		t.Errorf("short history: covered %q from %d", recent.Covered, recent.CoveredFrom)
+	}
+
+	flaky := store.sla("flaky", 24*time.Hour, 99.9)
+	if flaky.Status != "breached" {
+		t.Errorf("10%% down: status %q, want breached", flaky.Status)
+	}
+	if none := store.sla("none", 24*time.Hour, 99.9); none.Status != "no data" || none.Covered != "" {
+		t.Errorf("no checks: %+v", none)
+	}
+}
+
+func TestTimelineCoverage(t *testing.T) {
+	_, store := newTestStore(t)
+	loc := time.UTC
+	now := time.Date(2026, 3, 10, 15, 0, 0, 0, loc)
+	store.mu.Lock()
+	store.historyByID["p1"] = []CheckResult{
+		// History starts mid-day on the 8th; earlier days were pruned.
+		{TS: time.Date(2026, 3, 8, 12, 0, 0, 0, loc).UnixMilli(), Status: "HEALTHY"},
+		{TS: time.Date(2026, 3, 8, 18, 0, 0, 0, loc).UnixMilli(), Status: "HEALTHY"},
+		{TS: time.Date(2026, 3, 10, 9, 0, 0, 0, loc).UnixMilli(), Status: "DOWN"},
+	}
+	store.mu.Unlock()
+
+	days := store.timeline("p1", 5, loc, now)
+	want := []struct {
+		date    string
+		rating  string
+		partial bool
+	}{
+		{"2026-03-06", "insufficient data", false},
+		{"2026-03-07", "insufficient data", false},
+		{"2026-03-08", "ok", true},
+		{"2026-03-09", "no data", false},
+		{"2026-03-10", "outage", false},
+	}
+	for i, w := range want {
+		d := days[i]
+		if d.Date != w.date || d.Rating != w.rating || d.Partial != w.partial {
+			t.Errorf("day %d = %s %q partial=%v, want %s %q partial=%v", i, d.Date, d.Rating, d.Partial, w.date, w.rating, w.partial)
+		}
+	}
+
+	for _, d := range store.timeline("empty", 3, loc, now) {
+		if d.Rating != "no data" || d.Partial {
+			t.Errorf("no history: %+v, want no data", d)
+		}
+	}
+}
+
+func TestHistoryStatsUseRawChecks(t *testing.T) {
+	r, store := newTestServer(t)
+	const t0 = int64(1_700_000_040_000) // a whole minute
+	var checks []CheckResult
+	// Two minutes of checks at 100ms, with one 5s spike in the first. The
+	// bucket mean would hide the spike from p99.
+	for m := int64(0); m < 2; m++ {
+		for i := int64(0); i < 10; i++ {
+			latency := int64(100)
+			if m == 0 && i == 5 {
+				latency = 5000
+			}
+			checks = append(checks, CheckResult{TS: t0 + m*60_000 + i*1000, Status: "HEALTHY", LatencyMs: latency})
+		}
+	}
+	store.mu.Lock()
+	store.historyByID["p1"] = checks
+	store.mu.Unlock()
+
+	var resp struct {
+		Items       []CheckResult    `json:"items"`
+		Percentiles map[string]int64 `json:"percentiles"`
+	}
+	w := doJSON(r, "GET", "/api/v1/history?project_id=p1&resolution=1m&stats=true", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != 200 {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	if len(resp.Items) != 2 || resp.Items[0].LatencyMs != 590 || resp.Items[1].LatencyMs != 100 {
+		t.Fatalf("items = %+v, want 1m buckets averaging 590ms and 100ms", resp.Items)
+	}
+	if resp.Percentiles["p50"] != 100 || resp.Percentiles["p99"] != 5000 {
+		t.Errorf("percentiles = %v, want p50 100 and p99 5000 from raw checks", resp.Percentiles)
+	}
+
+	// With limit=1 only the last bucket is returned, so the spike is out.
+	w = doJSON(r, "GET", "/api/v1/history?project_id=p1&resolution=1m&stats=true&limit=1", "")
+	resp.Percentiles = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != 200 {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	if resp.Percentiles["p99"] != 100 {
+		t.Errorf("limit=1 percentiles = %v, want p99 100 from the last bucket's checks", resp.Percentiles)
+	}
+}
+
+func TestMTTRIsRateLimited(t *testing.T) {
+	t.Setenv("API_RATE_LIMIT", "2")
+	r, _ := newTestServer(t)
+	for i, want := range []int{200, 200, 429} {
+		w := doJSON(r, "GET", "/api/v1/mttr?project_id=p1", "")
+		if w.Code != want {
+			t.Errorf("request %d: status %d, want %d", i+1, w.Code, want)
+		}
+	}
+}
+
+func TestRequestLoggedOnceAsStructuredLine(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var ginOut, slogOut strings.Builder
+	defaultWriter, errorWriter := gin.DefaultWriter, gin.DefaultErrorWriter
+	gin.DefaultWriter, gin.DefaultErrorWriter = &ginOut, io.Discard
+	t.Cleanup(func() { gin.DefaultWriter, gin.DefaultErrorWriter = defaultWriter, errorWriter })
+
+	cfg, store := newTestStore(t)
+	live := &liveConfig{cfg: &cfg}
+	logger := slog.New(slog.NewJSONHandler(&slogOut, nil))
+	r := newRouter(live.get, store, NewCircuitBreaker(), newPingTransport(false, 0), logger)
+	r.GET("/test/panic", func(c *gin.Context) { panic("boom") })
+
+	if w := doJSON(r, "GET", "/api/v1/health", ""); w.Code != 200 {
+		t.Fatalf("health: status %d", w.Code)
+	}
+	if strings.Contains(ginOut.String(), "/api/v1/health") {
+		t.Errorf("gin's own logger also logged the request:\n%s", ginOut.String())
+	}
+	if n := strings.Count(slogOut.String(), `"path":"/api/v1/health"`); n != 1 {
+		t.Errorf("structured request lines = %d, want 1:\n%s", n, slogOut.String())
+	}
+
+	if w := doJSON(r, "GET", "/test/panic", ""); w.Code != 500 {
+		t.Errorf("panic: status %d, want 500", w.Code)
+	}
+	if !strings.Contains(slogOut.String(), `"path":"/test/panic","status":500`) {
+		t.Errorf("recovered panic not logged as a 500:\n%s", slogOut.String())
+	}
+}
+
+func TestPatchValidatesMergedKeywordRegex(t *testing.T) {
+	var stored string
+	var gets, patches int
+	supabase := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			gets++
+			w.Write([]byte(`[` + stored + `]`))
+		case "PATCH":
+			patches++
+			w.Write([]byte(`[{"id":"p1","name":"api","url":"https://api.example.com"}]`))
+		}
+	}))
+	defer supabase.Close()
+	t.Setenv("SUPABASE_URL", supabase.URL)
+	t.Setenv("SUPABASE_SERVICE_ROLE_KEY", "service")
+	t.Setenv("API_KEY", "admin")
+	r, _ := newTestServer(t)
+
+	patch := func(body string) int {
+		req := httptest.NewRequest("PATCH", "/api/v1/projects/p1", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "admin")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	cases := []struct {
+		name      string
+		stored    string
+		body      string
+		wantCode  int
+		wantGet   bool
+		wantWrite bool
+	}{
+		{"regex on against stored invalid keyword", `{"id":"p1","keyword":"a(b"}`, `{"keyword_regex":true}`, 400, true, false},
+		{"invalid keyword against stored regex flag", `{"id":"p1","keyword":"ok","keyword_regex":true}`, `{"keyword":"a(b"}`, 400, true, false},
+		{"invalid keyword without regex", `{"id":"p1","keyword":"ok"}`, `{"keyword":"a(b"}`, 200, true, true},
+		{"regex on against stored valid keyword", `{"id":"p1","keyword":"up|ok"}`, `{"keyword_regex":true}`, 200, true, true},
+		{"all given needs no lookup", `{"id":"p1","keyword":"a(b"}`, `{"keyword":"ok.*","keyword_regex":true,"method":"GET"}`, 200, false, true},
+		{"all given and invalid", ``, `{"keyword":"a(b","keyword_regex":true,"method":"GET"}`, 400, false, false},
+		{"keyword against stored HEAD", `{"id":"p1","method":"HEAD"}`, `{"keyword":"ok","keyword_regex":false}`, 400, true, false},
+		{"HEAD against stored keyword", `{"id":"p1","keyword":"ok"}`, `{"method":"head"}`, 400, true, false},
+		{"HEAD with keyword cleared", `{"id":"p1","keyword":"ok"}`, `{"method":"HEAD","keyword":"","keyword_regex":false}`, 200, false, true},
+		{"keyword with HEAD", ``, `{"keyword":"ok","keyword_regex":false,"method":"HEAD"}`, 400, false, false},
+		{"unrelated field needs no lookup", ``, `{"name":"api"}`, 200, false, true},
+		{"missing project", ``, `{"keyword_regex":true}`, 404, true, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			stored, gets, patches = tc.stored, 0, 0
+			if code := patch(tc.body); code != tc.wantCode {
+				t.Errorf("status %d, want %d", code, tc.wantCode)
+			}
+			if (gets > 0) != tc.wantGet {
+				t.Errorf("fetched the stored row %d times, want fetch=%v", gets, tc.wantGet)
+			}
+			if (patches > 0) != tc.wantWrite {
+				t.Errorf("sent %d PATCHes, want write=%v", patches, tc.wantWrite)
+			}
+		})
+	}
+}
+
+func TestRevokeTokenReuseRejected(t *testing.T) {
+	r, store := newTestServer(t)
+	token := signTestToken(t, ConfirmTokenPayload{Email: "revoke@example.com", Nonce: "revoke-nonce"})
+	if w := doJSON(r, "GET", "/api/v1/auth/confirm?token="+url.QueryEscape(token), ""); w.Code != 200 {
+		t.Fatalf("confirm: status %d, body %s", w.Code, w.Body)
+	}
+	body := `{"token":"` + token + `"}`
+
+	w := doJSON(r, "POST", "/api/v1/auth/revoke", body)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"revoked":true`) {
+		t.Fatalf("first revoke: status %d, body %s", w.Code, w.Body)
+	}
+	// A later confirmation must not be undone by replaying the old token.
+	store.confirmWithNonce("revoke@example.com", "confirm-again", time.Now().Add(time.Hour).Unix())
+	w = doJSON(r, "POST", "/api/v1/auth/revoke", body)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "token already used") {
+		t.Fatalf("second revoke: status %d, body %s; want 400 token already used", w.Code, w.Body)
+	}
+	if !store.isConfirmed("revoke@example.com") {
+		t.Error("replayed revoke removed the new confirmation")
+	}
+
+	noNonce := signTestToken(t, ConfirmTokenPayload{Email: "revoke@example.com"})
+	if w := doJSON(r, "POST", "/api/v1/auth/revoke", `{"token":"`+noNonce+`"}`); w.Code != 400 {
+		t.Errorf("token without nonce: status %d, want 400", w.Code)
+	}
+}
+
+// blockingBackend is a storeBackend whose first saveCheck hangs until
+// release is closed or its context expires.
+type blockingBackend struct {
+	release     chan struct{}
+	saved       chan CheckResult
+	hasDeadline chan bool
+}
+
+func (b *blockingBackend) saveCheck(ctx context.Context, projectID string, check CheckResult) error {
+	_, ok := ctx.Deadline()
+	select {
+	case b.hasDeadline <- ok:
+		select {
+		case <-b.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	default:
+	}
+	b.saved <- check
+	return nil
+}
+
+func (b *blockingBackend) saveIncident(context.Context, Incident) error { return nil }
+func (b *blockingBackend) loadHistory(int) (map[string][]CheckResult, error) {
+	return nil, nil
+}
+func (b *blockingBackend) loadIncidents(int) ([]Incident, error)       { return nil, nil }
+func (b *blockingBackend) deleteHistory(context.Context, string) error { return nil }
+func (b *blockingBackend) trimHistory(context.Context, int) error      { return nil }
+
+func TestBackendWritesDontHoldStoreLock(t *testing.T) {
+	_, store := newTestStore(t)
+	backend := &blockingBackend{
+		release:     make(chan struct{}),
+		saved:       make(chan CheckResult, 10),
+		hasDeadline: make(chan bool, 1),
+	}
+	store.useBackend(backend)
+	project := Project{ID: "p1", Name: "p1"}
+	const t0 = int64(1_700_000_000_000)
+
+	done := make(chan struct{})
+	go func() {
+		for i := int64(0); i < 3; i++ {
+			store.addCheck(project, CheckResult{TS: t0 + i, Status: "HEALTHY"})
+		}
+		store.allowAction("test", time.Minute, 1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("store blocked on a hung backend write")
+	}
+	if !<-backend.hasDeadline {
+		t.Error("backend write has no deadline")
+	}
+
+	close(backend.release)
+	for i := int64(0); i < 3; i++ {
+		select {
+		case check := <-backend.saved:
+			if check.TS != t0+i {
+				t.Errorf("write %d: TS %d, want %d", i, check.TS, t0+i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("write %d never reached the backend", i)
+		}
+	}
+}
+
+func TestSQLiteTrimHistory(t *testing.T) {
+	backend, err := openSQLiteBackend(t.TempDir() + "/heartbeat.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.db.Close()
+	ctx := context.Background()
+	for i := int64(1); i <= 5; i++ {
+		if err := backend.saveCheck(ctx, "p1", CheckResult{TS: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(1); i <= 2; i++ {
+		if err := backend.saveCheck(ctx, "p2", CheckResult{TS: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := backend.trimHistory(ctx, 3); err != nil {
+		t.Fatal(err)
+	}
+	history, err := backend.loadHistory(maxHistoryPerProject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsOf := func(checks []CheckResult) []int64 {
+		var out []int64
+		for _, c := range checks {
+			out = append(out, c.TS)
+		}
+		return out
+	}
+	if got := tsOf(history["p1"]); !reflect.DeepEqual(got, []int64{3, 4, 5}) {
+		t.Errorf("p1 after trim: %v, want [3 4 5]", got)
+	}
+	if got := tsOf(history["p2"]); !reflect.DeepEqual(got, []int64{1, 2}) {
+		t.Errorf("p2 after trim: %v, want [1 2]", got)
+	}
+}
+
+func TestInvalidateDiscardsInFlightFetch(t *testing.T) {
+	_, store := newTestStore(t)
+	store.mu.Lock()
+	store.projects.ttl = time.Minute
+	store.mu.Unlock()
+	before := []Project{{ID: "p1"}}
+	after := []Project{{ID: "p1"}, {ID: "p2"}}
+
+	// A write lands while both fetches are in flight with the old list.
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	done := make(chan struct{}, 2)
+	go func() {
+		store.cachedProjects(func() ([]Project, bool, error) {
+			started <- struct{}{}
+			<-release
+			return before, false, nil
+		})
+		done <- struct{}{}
+	}()
+	go func() {
+		store.cachedStatus(time.Minute, func() ([]Project, time.Duration, error) {
+			started <- struct{}{}
+			<-release
+			return before, 0, nil
+		})
+		done <- struct{}{}
+	}()
+	<-started
+	<-started
+	store.invalidateStatus()
+	close(release)
+	<-done
+	<-done
+
+	projects, _, _ := store.cachedProjects(func() ([]Project, bool, error) { return after, false, nil })
+	if len(projects) != 2 {
+		t.Errorf("cachedProjects after invalidate = %v, want the refetched list", projects)
+	}
+	status, _, _ := store.cachedStatus(time.Minute, func() ([]Project, time.Duration, error) { return after, 0, nil })
+	if len(status) != 2 {
+		t.Errorf("cachedStatus after invalidate = %v, want the refetched list", status)
+	}
+}
+
+// webhookStatuses starts a webhook receiver and returns its URL and a
+// function listing the incident statuses posted to it so far.
+func webhookStatuses(t *testing.T) (string, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var statuses []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Status string `json:"status"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		statuses = append(statuses, payload.Status)
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), statuses...)
+	}
+}
+
+func TestAcknowledgedIncidentSilencesRepeats(t *testing.T) {
+	cfg, store := newTestStore(t)
+	var got func() []string
+	cfg.WebhookURL, got = webhookStatuses(t)
+	const t0 = int64(1_700_000_000_000)
+	store.mu.Lock()
+	store.incidents = []Incident{{ID: "i1", ProjectID: "p1", Status: "DEGRADED", OpenedAt: t0, Acknowledged: true}}
+	store.mu.Unlock()
+
+	// Sustained-anomaly alerts arrive already resolved; reminders are open.
+	notifyIncident(cfg, testLogger, store, Incident{ID: "a1", ProjectID: "p1", Status: "ANOMALY", Severity: "warning", OpenedAt: t0, ResolvedAt: t0})
+	notifyIncident(cfg, testLogger, store, Incident{ID: "i1", ProjectID: "p1", Status: "DEGRADED", Severity: "warning", OpenedAt: t0})
+	notifyIncident(cfg, testLogger, store, Incident{ID: "o1", ProjectID: "other", Status: "ANOMALY", Severity: "warning", OpenedAt: t0, ResolvedAt: t0})
+	notifyIncident(cfg, testLogger, store, Incident{ID: "i1", ProjectID: "p1", Status: "HEALTHY", Severity: "info", OpenedAt: t0, ResolvedAt: t0})
+	if want := []string{"ANOMALY", "HEALTHY"}; !reflect.DeepEqual(got(), want) {
+		t.Errorf("webhooks = %q, want %q (the other project's anomaly and the recovery)", got(), want)
+	}
+}
+
+func TestStatusDiffKeepsChangesCommittedAfterCursor(t *testing.T) {
+	r, store := newTestServer(t)
+	project := Project{ID: "p1", Name: "API"}
+	now := time.Now().UnixMilli()
+	store.addCheck(project, CheckResult{TS: now - 5_000, Status: "HEALTHY"})
+
+	w := doJSON(r, "GET", "/api/v1/status/diff?since_ts=0", "")
+	var resp struct {
+		ServerTS int64          `json:"server_ts"`
+		Projects []StatusChange `json:"projects"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != 200 {
+		t.Fatalf("status %d, body %s, err %v", w.Code, w.Body, err)
+	}
+	if resp.ServerTS == 0 || len(resp.Projects) != 1 {
+		t.Fatalf("first diff = %s, want server_ts and p1", w.Body)
+	}
+
+	// This check started before the cursor was handed out but is recorded
+	// after it.
+	store.addCheck(project, CheckResult{TS: resp.ServerTS - 1_000, Status: "DOWN"})
+	changes, next := store.statusDiff(resp.ServerTS)
+	if len(changes) != 1 || changes[0].Status != "DOWN" || changes[0].PreviousStatus != "HEALTHY" {
+		t.Fatalf("diff since cursor = %+v, want p1 HEALTHY -> DOWN", changes)
+	}
+	if next < resp.ServerTS {
+		t.Errorf("cursor went backwards: %d after %d", next, resp.ServerTS)
+	}
+
+	// Flapping back to the status at since isn't a change.
+	store.addCheck(project, CheckResult{TS: next - 500, Status: "DOWN"})
+	store.addCheck(project, CheckResult{TS: next - 400, Status: "HEALTHY"})
+	store.addCheck(project, CheckResult{TS: next - 300, Status: "DOWN"})
+	if changes, _ := store.statusDiff(next); len(changes) != 0 {
+		t.Errorf("diff after flapping back = %+v, want none", changes)
+	}
+}
+
+func TestPingHeadLeavesContentFieldsEmpty(t *testing.T) {
+	cfg, store := newTestStore(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", "1234")
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+
+	head := pingOnce(t, &Project{ID: "head", URL: srv.URL, Method: "HEAD"}, cfg, http.DefaultTransport, store)
+	if head.Status != "HEALTHY" || head.ContentType != "" || head.ContentLength != 0 {
+		t.Errorf("HEAD: status %s, content type %q, length %d; want HEALTHY with both empty", head.Status, head.ContentType, head.ContentLength)
+	}
+	get := pingOnce(t, &Project{ID: "get", URL: srv.URL}, cfg, http.DefaultTransport, store)
+	if get.ContentType != "text/html" {
+		t.Errorf("GET: content type %q, want text/html", get.ContentType)
+	}
+}
+
+func TestIncidentSeverity(t *testing.T) {
+	cases := []struct {
+		status string
+		want   string
+	}{
+		{"HEALTHY", "info"},
+		{"DOWN", "critical"},
+		{"ISOLATED", "critical"},
+		{"DEGRADED", "warning"},
+		{"SLOW", "warning"},
+		{"REDIRECT", "warning"},
+		{"CERT_EXPIRING", "warning"},
+		{"ANOMALY", "warning"},
+		{"TEST", "warning"},
+	}
+	for _, tc := range cases {
+		if got := incidentSeverity(tc.status); got != tc.want {
+			t.Errorf("incidentSeverity(%q) = %q, want %q", tc.status, got, tc.want)
+		}
+	}
+	if !(severityRank("info") < severityRank("warning") && severityRank("warning") < severityRank("critical")) {
+		t.Error("severities must rank info < warning < critical")
+	}
+	if got := severityRank("urgent"); got != 0 {
+		t.Errorf("severityRank(unknown) = %d, want 0", got)
+	}
+}
+
+func TestMinNotifySeverity(t *testing.T) {
+	cases := []struct {
+		min  string
+		want []string
+	}{
+		{"info", []string{"HEALTHY", "SLOW", "DOWN"}},
+		{"warning", []string{"SLOW", "DOWN"}},
+		{"critical", []string{"DOWN"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.min, func(t *testing.T) {
+			cfg, store := newTestStore(t)
+			cfg.MinNotifySeverity = tc.min
+			var got func() []string
+			cfg.WebhookURL, got = webhookStatuses(t)
+			for _, status := range []string{"HEALTHY", "SLOW", "DOWN"} {
+				notifyIncident(cfg, testLogger, store, Incident{ID: status, ProjectID: "p1", Status: status, Severity: incidentSeverity(status)})
+			}
+			if !reflect.DeepEqual(got(), tc.want) {
+				t.Errorf("notified %q, want %q", got(), tc.want)
+			}
+		})
+	}
+}
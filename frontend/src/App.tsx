@@ -8,7 +8,7 @@ import { decodeProjectId, encodeProjectId } from './encoding';
 import { useSession } from './session';
 import { sendConfirmationEmail } from './emailjs';
 
-type ProjectStatus = 'HEALTHY' | 'DEGRADED' | 'DOWN';
+type ProjectStatus = 'HEALTHY' | 'SLOW' | 'REDIRECT' | 'DEGRADED' | 'DOWN' | 'DISABLED' | 'PENDING';
 
 interface Project {
   id: string;
@@ -496,18 +496,25 @@ function DashboardPage() {
       setProjects(nextProjects);
       void fetchIncidents();
       void (async () => {
-        for (const p of nextProjects) {
-          if (fetchedHistoryIdsRef.current.has(p.id)) continue;
-          fetchedHistoryIdsRef.current.add(p.id);
+        const ids = nextProjects.map((p) => p.id).filter((id) => !fetchedHistoryIdsRef.current.has(id));
+        // The bulk endpoint accepts at most 100 IDs per request.
+        for (let i = 0; i < ids.length; i += 100) {
+          const chunk = ids.slice(i, i + 100);
+          chunk.forEach((id) => fetchedHistoryIdsRef.current.add(id));
           try {
-            const hRes = await fetch(apiUrl(`/api/v1/history?project_id=${encodeURIComponent(p.id)}&limit=24`));
+            const query = chunk.map(encodeURIComponent).join(',');
+            const hRes = await fetch(apiUrl(`/api/v1/history/bulk?project_ids=${query}&limit=24`));
             if (!hRes.ok) continue;
-            const hData = (await hRes.json()) as { items?: Array<{ latency?: number }> };
-            const items = Array.isArray(hData.items) ? hData.items : [];
-            setStatusHistory((prev) => ({
-              ...prev,
-              [p.id]: items.map((i) => i.latency ?? 0),
-            }));
+            const hData = (await hRes.json()) as { items?: Record<string, Array<{ latency?: number }>> };
+            const byId = hData.items ?? {};
+            setStatusHistory((prev) => {
+              const next = { ...prev };
+              for (const id of chunk) {
+                const items = Array.isArray(byId[id]) ? byId[id] : [];
+                next[id] = items.map((item) => item.latency ?? 0);
+              }
+              return next;
+            });
           } catch {
             // ignore
           }
@@ -954,9 +961,15 @@ function ProCard({
           className={`h-2.5 w-2.5 rounded-full animate-pulse ${
             project.status === 'HEALTHY'
               ? 'bg-emerald-500 shadow-[0_0_12px_#10b981]'
-              : project.status === 'DEGRADED'
-                ? 'bg-amber-500 shadow-[0_0_12px_#f59e0b]'
-                : 'bg-rose-500 shadow-[0_0_12px_#f43f5e]'
+              : project.status === 'SLOW'
+                ? 'bg-lime-500 shadow-[0_0_12px_#84cc16]'
+                : project.status === 'REDIRECT'
+                  ? 'bg-sky-500 shadow-[0_0_12px_#0ea5e9]'
+                  : project.status === 'DEGRADED'
+                    ? 'bg-amber-500 shadow-[0_0_12px_#f59e0b]'
+                    : project.status === 'DISABLED' || project.status === 'PENDING'
+                      ? 'bg-zinc-600'
+                      : 'bg-rose-500 shadow-[0_0_12px_#f43f5e]'
           }`}
         />
       </div>